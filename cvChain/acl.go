@@ -0,0 +1,197 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ownerIDAttr is the certificate attribute identifying the owner of the
+// records a client may read
+const ownerIDAttr = "ownerId"
+
+// isIssuerOrg reports whether mspID is on the issuer allow-list
+func isIssuerOrg(cfg *chaincodeConfig, mspID string) bool {
+	for _, org := range cfg.IssuerOrgs {
+		if org == mspID {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIssuerOrg returns an error unless the caller is a member of an
+// issuer organization, once they are configured. It returns the MSP ID of
+// the caller, or an empty one if no issuer organizations are configured
+func checkIssuerOrg(stub shim.ChaincodeStubInterface) (string, error) {
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return "", err
+	}
+	if len(cfg.IssuerOrgs) == 0 {
+		return "", nil
+	}
+
+	mspID, err := callerMSPID(stub)
+	if err != nil {
+		return "", err
+	}
+	if !isIssuerOrg(cfg, mspID) {
+		return "", errorf(codeForbidden, "access denied: %s is not an issuer organization", mspID)
+	}
+	return mspID, nil
+}
+
+// checkIssuer returns an error unless the caller may write the record
+// document doc: once issuer organizations are configured, only their
+// members may write records, and only records naming their MSP as issuer
+func checkIssuer(stub shim.ChaincodeStubInterface, doc string) error {
+	mspID, err := checkIssuerOrg(stub)
+	if err != nil || mspID == "" {
+		return err
+	}
+	r := Record{}
+	err = json.Unmarshal([]byte(doc), &r)
+	if err != nil {
+		return err
+	}
+	if r.Issuer != mspID {
+		return errorf(codeForbidden, "access denied: a record written by %s must name it as issuer, got %s", mspID, r.Issuer)
+	}
+	return nil
+}
+
+// checkRecordIssuer returns an error unless the caller is a member of the
+// issuer organization of the record whose stored value is stored, once
+// issuer organizations are configured. The issuer of an encrypted record
+// is not known, so only checkWriter applies to it
+func checkRecordIssuer(stub shim.ChaincodeStubInterface, stored []byte) error {
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+	if len(cfg.IssuerOrgs) == 0 {
+		return nil
+	}
+
+	r := Record{}
+	if json.Unmarshal(stored, &r) != nil {
+		return nil
+	}
+	mspID, err := callerMSPID(stub)
+	if err != nil {
+		return err
+	}
+	if mspID != r.Issuer {
+		return errorf(codeForbidden, "access denied: %s is not the issuer of the record, %s is", mspID, r.Issuer)
+	}
+	return nil
+}
+
+// checkReader returns an error unless the caller may read the record at
+// key of owner whose stored value is stored, nil if there is none: once
+// issuer organizations are configured, or owner consent is required, only
+// members of the issuer organization of a record, identities whose
+// ownerId attribute is its owner and grantees of an unexpired grant may
+// read it, checked in that order. The same error is returned whether or
+// not the record exists, except to its owner
+func checkReader(stub shim.ChaincodeStubInterface, key, owner string, stored []byte) error {
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+	if len(cfg.IssuerOrgs) == 0 && !cfg.OwnerConsent {
+		return nil
+	}
+
+	denied := errorf(codeForbidden, "access denied to the records of %s", owner)
+	ownerID, isSet, err := callerAttribute(stub, ownerIDAttr)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		if isSet && ownerID == owner {
+			return nil
+		}
+		return denied
+	}
+
+	r := Record{}
+	if json.Unmarshal(stored, &r) != nil {
+		// not a plaintext record; its issuer is indexed if it is encrypted
+		r = Record{Owner: owner}
+		indexKey, err := recordIndexKey(stub, issuerIndex, key)
+		if err != nil {
+			return err
+		}
+		issuer, err := stub.GetState(indexKey)
+		if err != nil {
+			return err
+		}
+		r.Issuer = string(issuer)
+	}
+	mspID, err := callerMSPID(stub)
+	if err != nil {
+		return err
+	}
+	if r.Issuer != "" && mspID == r.Issuer {
+		return nil
+	}
+	if isSet && ownerID == r.Owner {
+		return nil
+	}
+	granted, err := hasGrant(stub, key, mspID)
+	if err != nil {
+		return err
+	}
+	if granted {
+		return nil
+	}
+	return denied
+}
+
+// readable wraps fn, passed to the record iterators, so that it is only
+// called with the records the caller may read, as checkReader decides
+func readable(stub shim.ChaincodeStubInterface, fn func(key string, value []byte) error) func(key string, value []byte) error {
+	return func(key string, value []byte) error {
+		owner, _ := splitKey(stub, key)
+		if checkReader(stub, key, owner, value) != nil {
+			return nil
+		}
+		return fn(key, value)
+	}
+}
+
+// setIssuerOrgs replaces the issuer allow-list with the MSP IDs in args,
+// if the caller is the admin
+func setIssuerOrgs(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting at least one MSP ID")
+	}
+
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return "", err
+	}
+	err = requireAdmin(stub, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	cfg.IssuerOrgs = args
+	err = putConfig(stub, cfg)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(args)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
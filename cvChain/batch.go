@@ -0,0 +1,264 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/entities"
+)
+
+// maxBatchSize bounds the number of records of a single batch; the
+// configuration may lower it
+const maxBatchSize = 1000
+
+type writeResult struct {
+	Key   string `json:"key"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type batchResult struct {
+	Count int      `json:"count"`
+	Keys  []string `json:"keys"`
+}
+
+// parseBatch returns the records of the JSON array in args[0], each given
+// as the three arguments of createRecord, up to the configured batch size
+func parseBatch(stub shim.ChaincodeStubInterface, args []string) ([][]string, error) {
+	if len(args) != 1 {
+		return nil, errorf(codeBadRequest, "Incorrect arguments. Expecting a JSON array of records")
+	}
+	records := [][]string{}
+	err := json.Unmarshal([]byte(args[0]), &records)
+	if err != nil {
+		return nil, errorf(codeBadRequest, "Invalid records, err %s", err)
+	}
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+	limit := maxBatchSize
+	if cfg.MaxBatchSize > 0 {
+		limit = cfg.MaxBatchSize
+	}
+	if len(records) > limit {
+		return nil, errorf(codeBadRequest, "Too many records %d, at most %d are allowed", len(records), limit)
+	}
+	return records, nil
+}
+
+// validateBatch checks every record of a batch the way the write would,
+// without writing anything, and returns the keys of the records or an
+// error naming the index of the first invalid one. A key may only appear
+// once in a batch, regardless of case if case-insensitive ids are
+// enabled, and must not exist yet. The records of each owner,
+// whose documents take size bytes once stored, must fit its quota and
+// record limit all together
+func validateBatch(stub shim.ChaincodeStubInterface, records [][]string, size func(value string) int) ([]string, error) {
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(records))
+	seen := map[string]int{}
+	added := map[string]batchUsage{}
+	for i, record := range records {
+		if len(record) != 3 {
+			return nil, errorf(codeBadRequest, "Invalid record %d: expecting a key and a record", i)
+		}
+		key, err := resolveKey(stub, record[0], record[1], false)
+		if err != nil {
+			return nil, errorf(codeBadRequest, "Invalid record %d: %s", i, err)
+		}
+		seenKey := key
+		if cfg.CaseInsensitiveIDs {
+			seenKey, err = foldKey(stub, key)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if j, in := seen[seenKey]; in {
+			return nil, errorf(codeBadRequest, "Invalid record %d: same key as record %d", i, j)
+		}
+		seen[seenKey] = i
+		value, err := makeRecord(stub, key, record)
+		if err != nil {
+			return nil, errorf(codeBadRequest, "Invalid record %d: %s", i, err)
+		}
+		// a denied issuer or an existing key keeps the code of the error
+		err = checkIssuer(stub, value)
+		if err != nil {
+			return nil, errorf(errorCode(err), "Invalid record %d: %s", i, err)
+		}
+		existing, err := stub.GetState(key)
+		if err == nil && existing != nil {
+			err = errorf(codeConflict, "Asset already exists: %s", key)
+		}
+		if err != nil {
+			return nil, errorf(errorCode(err), "Invalid record %d: %s", i, err)
+		}
+		keys = append(keys, key)
+
+		owner, _ := splitKey(stub, key)
+		usage := added[owner]
+		usage.records++
+		usage.bytes += size(value)
+		added[owner] = usage
+	}
+	err = checkBatchQuota(stub, added)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// addRecords writes all the records of the JSON array in args[0], each
+// given as the three arguments of createRecord, or none of them: every
+// record is validated before the first is written, and the index of the
+// first invalid one is reported, as is the first owner the batch would
+// take over its quota. A write can still be denied; the invoke then
+// fails, and none of its writes are committed
+func addRecords(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	records, err := parseBatch(stub, args)
+	if err != nil {
+		return "", err
+	}
+	keys, err := validateBatch(stub, records, func(value string) int {
+		return len(value)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return writeBatch(stub, records, keys, func(record []string) (recordEvent, error) {
+		_, event, err := putRecord(stub, record, checkOwnerQuota)
+		return event, err
+	})
+}
+
+// encRecords is the variant of addRecords encrypting every record with
+// the AES 256 bit key provided through the transient field. Every record
+// gets a random IV; a fixed one would be reused across the batch
+func (t *SimpleAsset) encRecords(stub shim.ChaincodeStubInterface, args []string, encKey []byte) (string, error) {
+	ent, err := entities.NewAES256EncrypterEntity("ID", t.bccspInst, encKey, nil)
+	if err != nil {
+		return "", errorf(codeCryptoError, "entities.NewAES256EncrypterEntity failed, err %s", err)
+	}
+	records, err := parseBatch(stub, args)
+	if err != nil {
+		return "", err
+	}
+	keys, err := validateBatch(stub, records, func(value string) int {
+		return ciphertextSize(len(value))
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return writeBatch(stub, records, keys, func(record []string) (recordEvent, error) {
+		_, event, err := t.putEncrypted(stub, encKey, record, encryptValue(ent))
+		return event, err
+	})
+}
+
+// writeBatch writes the validated records, whose keys are keys, with put
+// and emits the event listing the writes
+func writeBatch(stub shim.ChaincodeStubInterface, records [][]string, keys []string, put func(record []string) (recordEvent, error)) (string, error) {
+	events := []recordEvent{}
+	for i, record := range records {
+		event, err := put(record)
+		if err != nil {
+			return "", fmt.Errorf("Failed to write record %d: %s", i, err)
+		}
+		events = append(events, event)
+	}
+	result := batchResult{Count: len(keys), Keys: keys}
+	err := emitEvents(stub, events)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// addRecordsLenient writes each of the records of the JSON array in
+// args[0], every one given as the three arguments of createRecord, and
+// returns a result per record instead of failing on the first invalid
+// one. Note that the transaction still commits or fails as a whole: the
+// records reported as written are only on the ledger once the
+// transaction is validated, and none of them are if it is invalidated,
+// e.g. by an MVCC conflict. A failed record writes nothing, neither the
+// record nor its fold index entry, so the client can resubmit only the
+// failures. Since GetState does not see the writes of the current
+// transaction, a key is written at most once: the records following the
+// one written with the same key, regardless of case if case-insensitive
+// ids are enabled, are reported as failures. For the same reason the
+// quota of each owner is checked against its usage before the batch plus
+// that of the records of the batch written so far
+func addRecordsLenient(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	records, err := parseBatch(stub, args)
+	if err != nil {
+		return "", err
+	}
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return "", err
+	}
+
+	results := make([]writeResult, 0, len(records))
+	events := []recordEvent{}
+	seen := map[string]int{}
+	quota := newBatchQuota(cfg)
+	for i, record := range records {
+		result := writeResult{}
+		if len(record) >= 2 {
+			// invalid ids are reported by putRecord below
+			result.Key, _ = resolveKey(stub, record[0], record[1], false)
+		}
+		seenKey := result.Key
+		if seenKey != "" && cfg.CaseInsensitiveIDs {
+			seenKey, err = foldKey(stub, result.Key)
+			if err != nil {
+				return "", err
+			}
+		}
+		if j, in := seen[seenKey]; in {
+			result.Error = fmt.Sprintf("same key as record %d", j)
+			results = append(results, result)
+			continue
+		}
+		value, event, err := putRecord(stub, record, quota.check)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.OK = true
+			events = append(events, event)
+			seen[seenKey] = i
+			quota.add(stub, result.Key, len(value))
+		}
+		results = append(results, result)
+	}
+	// a transaction carries a single event, so the events of the records
+	// are emitted together
+	err = emitEvents(stub, events)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(results)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,87 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	// benchIndex is the composite key object type benchmark writes go to
+	benchIndex = "bench"
+	// maxBenchOps bounds the number of writes of a single benchmark
+	maxBenchOps = 10000
+	// maxBenchValueSize bounds the size of each benchmark value
+	maxBenchValueSize = 64 * 1024
+)
+
+type benchmarkStats struct {
+	Ops       int   `json:"ops"`
+	ValueSize int   `json:"valueSize"`
+	TotalNs   int64 `json:"totalNs"`
+	PerOpNs   int64 `json:"perOpNs"`
+}
+
+// benchmarkWrite performs args[0] PutState calls of an args[1] bytes
+// value and returns how long they took. Each PutState is a round trip
+// to the peer, which only buffers the write in the transaction's write
+// set. The timings differ between endorsers, so the function must be
+// evaluated as a query rather than submitted for ordering
+func benchmarkWrite(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a number of writes and a value size")
+	}
+	ops, err := strconv.Atoi(args[0])
+	if err != nil || ops <= 0 || ops > maxBenchOps {
+		return "", errorf(codeBadRequest, "Invalid number of writes %s, must be between 1 and %d", args[0], maxBenchOps)
+	}
+	size, err := strconv.Atoi(args[1])
+	if err != nil || size < 0 || size > maxBenchValueSize {
+		return "", errorf(codeBadRequest, "Invalid value size %s, must be between 0 and %d", args[1], maxBenchValueSize)
+	}
+
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return "", err
+	}
+	err = requireAdmin(stub, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	value := bytes.Repeat([]byte{'x'}, size)
+	start := time.Now()
+	for i := 0; i < ops; i++ {
+		key, err := stub.CreateCompositeKey(benchIndex, []string{strconv.Itoa(i)})
+		if err != nil {
+			return "", err
+		}
+		err = stub.PutState(key, value)
+		if err != nil {
+			return "", fmt.Errorf("Failed to write benchmark value %d: %s", i, err)
+		}
+	}
+	total := time.Since(start)
+
+	stats := benchmarkStats{
+		Ops:       ops,
+		ValueSize: size,
+		TotalNs:   total.Nanoseconds(),
+		PerOpNs:   total.Nanoseconds() / int64(ops),
+	}
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,198 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/pkg/errors"
+)
+
+// configKey is the reserved ledger key the chaincode configuration is
+// stored under. Record keys always contain a separator, so it cannot
+// clash with them
+const configKey = "CONFIG"
+
+// instantiatedKey is the reserved ledger key the time of the last Init,
+// i.e. of the instantiation or upgrade of the running version, is
+// stored under
+const instantiatedKey = "INSTANTIATED"
+
+// chaincodeConfig holds the deployment-wide settings supplied to Init
+type chaincodeConfig struct {
+	// CaseInsensitiveIDs folds record ids to lowercase when resolving keys
+	CaseInsensitiveIDs bool `json:"caseInsensitiveIds"`
+	// AdminMSP is the MSP ID whose members may change settings at runtime
+	AdminMSP string `json:"adminMsp"`
+	// OwnerQuota caps the value bytes stored per owner; zero means no cap
+	OwnerQuota int `json:"ownerQuota"`
+	// OwnerRecordLimit caps the records stored per owner; zero means no cap
+	OwnerRecordLimit int `json:"ownerRecordLimit"`
+	// EscrowPublicKey is the PEM encoded RSA public key every encryption
+	// key is wrapped for; when empty, no key escrow takes place
+	EscrowPublicKey string `json:"escrowPublicKey"`
+	// MaxTransientSize caps the bytes, keys included, of the transient map
+	// of an invocation; zero means no cap
+	MaxTransientSize int `json:"maxTransientSize"`
+	// IssuerOrgs lists the MSP IDs allowed to write records; when empty,
+	// neither writes nor reads of records are restricted by organization
+	IssuerOrgs []string `json:"issuerOrgs"`
+	// MaxBatchSize caps the records of a batch below maxBatchSize; zero
+	// means maxBatchSize
+	MaxBatchSize int `json:"maxBatchSize"`
+	// RequireEncryption rejects the writes of plaintext records, so that
+	// records are only written encrypted
+	RequireEncryption bool `json:"requireEncryption"`
+	// OwnerConsent restricts the reads of records to their issuer, their
+	// owner and the grantees of their owner even when no issuer
+	// organizations are configured
+	OwnerConsent bool `json:"ownerConsent"`
+}
+
+// validate returns an error if a setting of the configuration is out of
+// range or malformed
+func (cfg *chaincodeConfig) validate() error {
+	limits := []struct {
+		name  string
+		value int
+	}{
+		{"ownerQuota", cfg.OwnerQuota},
+		{"ownerRecordLimit", cfg.OwnerRecordLimit},
+		{"maxTransientSize", cfg.MaxTransientSize},
+		{"maxBatchSize", cfg.MaxBatchSize},
+	}
+	for _, limit := range limits {
+		if limit.value < 0 {
+			return errorf(codeBadRequest, "Invalid configuration: %s must not be negative, got %d", limit.name, limit.value)
+		}
+	}
+	if cfg.MaxBatchSize > maxBatchSize {
+		return errorf(codeBadRequest, "Invalid configuration: maxBatchSize must be at most %d, got %d", maxBatchSize, cfg.MaxBatchSize)
+	}
+	for _, org := range cfg.IssuerOrgs {
+		if org == "" {
+			return errorf(codeBadRequest, "Invalid configuration: empty MSP ID in issuerOrgs")
+		}
+	}
+	if cfg.EscrowPublicKey != "" {
+		_, err := parseEscrowKey(cfg.EscrowPublicKey)
+		if err != nil {
+			return errorf(codeBadRequest, "Invalid configuration: escrowPublicKey: %s", err)
+		}
+	}
+	return nil
+}
+
+// getConfig reads the configuration from the ledger; the defaults are
+// returned if Init was never given one. The configuration is read on
+// every call instead of being cached since the chaincode container may
+// be restarted at any time
+func getConfig(stub shim.ChaincodeStubInterface) (*chaincodeConfig, error) {
+	cfg := &chaincodeConfig{}
+	b, err := stub.GetState(configKey)
+	if err != nil {
+		return nil, errors.WithMessage(err, "could not read configuration")
+	}
+	if b == nil {
+		return cfg, nil
+	}
+
+	err = json.Unmarshal(b, cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal configuration")
+	}
+	return cfg, nil
+}
+
+// putConfig stores the supplied configuration on the ledger
+func putConfig(stub shim.ChaincodeStubInterface, cfg *chaincodeConfig) error {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal configuration")
+	}
+	return stub.PutState(configKey, b)
+}
+
+// getEffectiveConfig returns the json configuration in effect, defaults
+// included, if the caller is the admin. It is read-only, meant for
+// queries
+func getEffectiveConfig(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 0 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting no arguments")
+	}
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return "", err
+	}
+	err = requireAdmin(stub, cfg)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// checkPlaintextAllowed returns an error if the configuration requires
+// records to be written encrypted
+func checkPlaintextAllowed(stub shim.ChaincodeStubInterface) error {
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+	if cfg.RequireEncryption {
+		return errorf(codeForbidden, "access denied: the configuration requires records to be written encrypted")
+	}
+	return nil
+}
+
+// putInstantiatedAt stores the timestamp of the current transaction as
+// the time the running version went live
+func putInstantiatedAt(stub shim.ChaincodeStubInterface) error {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errors.WithMessage(err, "could not get transaction timestamp")
+	}
+	return stub.PutState(instantiatedKey, []byte(formatTimestamp(ts)))
+}
+
+// instantiatedAt returns the RFC 3339 time the running version of the
+// chaincode was instantiated or upgraded at
+func instantiatedAt(stub shim.ChaincodeStubInterface) (string, error) {
+	b, err := stub.GetState(instantiatedKey)
+	if err != nil {
+		return "", errors.WithMessage(err, "could not read instantiation time")
+	}
+	if b == nil {
+		return "", errors.New("instantiation time not recorded")
+	}
+	return string(b), nil
+}
+
+// checkTransientSize returns an error if the transient map is larger than
+// the configured limit
+func checkTransientSize(stub shim.ChaincodeStubInterface, tMap map[string][]byte) error {
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+	if cfg.MaxTransientSize == 0 {
+		return nil
+	}
+
+	size := 0
+	for k, v := range tMap {
+		size += len(k) + len(v)
+	}
+	if size > cfg.MaxTransientSize {
+		return errorf(codeBadRequest, "transient data of %d bytes exceeds the limit of %d bytes", size, cfg.MaxTransientSize)
+	}
+	return nil
+}
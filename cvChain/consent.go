@@ -0,0 +1,244 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/pkg/errors"
+)
+
+// grantIndex is the composite key object type the read grants of a record
+// are stored under, keyed by the record and the grantee
+const grantIndex = "grant"
+
+// accessGrant is the value of a grantIndex entry. The grantee is either
+// an MSP ID, whose members may read the record, or a certificate
+// attribute written name=value, which the certificate of a reader must
+// carry
+type accessGrant struct {
+	Grantee   string `json:"grantee"`
+	Expiry    string `json:"expiry"`
+	GrantedAt string `json:"grantedAt"`
+}
+
+// active reports whether the grant has not expired at the time now; a
+// grant expires at its expiry time
+func (g *accessGrant) active(now time.Time) bool {
+	expiry, err := time.Parse(time.RFC3339Nano, g.Expiry)
+	return err == nil && now.Before(expiry)
+}
+
+// matches reports whether the grantee of the grant is the caller, a member
+// of mspID
+func (g *accessGrant) matches(stub shim.ChaincodeStubInterface, mspID string) (bool, error) {
+	name, value, isAttr := splitAttrGrantee(g.Grantee)
+	if !isAttr {
+		return g.Grantee == mspID, nil
+	}
+	attr, isSet, err := callerAttribute(stub, name)
+	if err != nil {
+		return false, err
+	}
+	return isSet && attr == value, nil
+}
+
+// splitAttrGrantee splits a certificate attribute grantee into the name
+// and the value of the attribute
+func splitAttrGrantee(grantee string) (string, string, bool) {
+	parts := strings.SplitN(grantee, "=", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// txTime returns the time of the current transaction, which grants are
+// checked against so that every endorser reaches the same decision
+func txTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, errors.WithMessage(err, "could not get transaction timestamp")
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+// requireOwner returns an error unless the caller is the owner of the
+// record at key, as identified by its ownerId attribute
+func requireOwner(stub shim.ChaincodeStubInterface, key string) error {
+	owner, _ := splitKey(stub, key)
+	ownerID, isSet, err := callerAttribute(stub, ownerIDAttr)
+	if err != nil {
+		return err
+	}
+	if !isSet || ownerID != owner {
+		return errorf(codeForbidden, "access denied: only the owner %s manages the access to its records", owner)
+	}
+	return nil
+}
+
+// ownedRecordKey resolves the key of the existing record at ids, which
+// the caller must own
+func ownedRecordKey(stub shim.ChaincodeStubInterface, id1, id2 string) (string, error) {
+	key, err := resolveKey(stub, id1, id2, false)
+	if err != nil {
+		return "", err
+	}
+	err = requireOwner(stub, key)
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", id1, err)
+	}
+	if value == nil {
+		return "", errorf(codeNotFound, "Asset not found: %s", id1)
+	}
+	return key, nil
+}
+
+// grantAccess lets the grantee in args[2], an MSP ID or a certificate
+// attribute written name=value, read the record at args[0:2] until the
+// RFC3339 time in args[3]. Only the owner of the record may grant access
+// to it; a grant replaces an earlier one to the same grantee. Grants only
+// matter once reads are restricted, by the issuer allow-list or the
+// ownerConsent setting
+func grantAccess(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 4 || args[2] == "" {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key, a grantee and an expiry")
+	}
+	expiry, err := time.Parse(time.RFC3339Nano, args[3])
+	if err != nil {
+		return "", errorf(codeBadRequest, "Invalid expiry %s, expecting an RFC3339 timestamp", args[3])
+	}
+	key, err := ownedRecordKey(stub, args[0], args[1])
+	if err != nil {
+		return "", err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return "", err
+	}
+	if !now.Before(expiry) {
+		return "", errorf(codeBadRequest, "Invalid expiry %s, the grant would already have expired", args[3])
+	}
+
+	grant := accessGrant{
+		Grantee:   args[2],
+		Expiry:    expiry.UTC().Format(time.RFC3339Nano),
+		GrantedAt: now.Format(time.RFC3339Nano),
+	}
+	b, err := json.Marshal(grant)
+	if err != nil {
+		return "", err
+	}
+	indexKey, err := recordIndexKey(stub, grantIndex, key, args[2])
+	if err != nil {
+		return "", err
+	}
+	err = stub.PutState(indexKey, b)
+	if err != nil {
+		return "", fmt.Errorf("Failed to grant access to asset: %s", args[0])
+	}
+	return string(b), nil
+}
+
+// revokeAccess withdraws the grant of the record at args[0:2] to the
+// grantee in args[2], which must have been granted access, expired or not
+func revokeAccess(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 3 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key and a grantee")
+	}
+	key, err := ownedRecordKey(stub, args[0], args[1])
+	if err != nil {
+		return "", err
+	}
+	indexKey, err := recordIndexKey(stub, grantIndex, key, args[2])
+	if err != nil {
+		return "", err
+	}
+	grant, err := stub.GetState(indexKey)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get grant: %s with error: %s", args[2], err)
+	}
+	if grant == nil {
+		return "", errorf(codeNotFound, "Grant not found: %s was not granted access to %s", args[2], args[0])
+	}
+	err = stub.DelState(indexKey)
+	if err != nil {
+		return "", fmt.Errorf("Failed to revoke access to asset: %s", args[0])
+	}
+	return string(grant), nil
+}
+
+// listGrants returns the json list of the grants of the record at
+// args[0:2] that have not expired, for its owner to audit who may read
+// it. Being read-only, it is meant for queries
+func listGrants(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key")
+	}
+	key, err := ownedRecordKey(stub, args[0], args[1])
+	if err != nil {
+		return "", err
+	}
+	grants, err := activeGrants(stub, key)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(grants)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// activeGrants returns the grants of the record at key that have not
+// expired at the time of the transaction, in grantee order
+func activeGrants(stub shim.ChaincodeStubInterface, key string) ([]accessGrant, error) {
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := recordIndexEntries(stub, grantIndex, key)
+	if err != nil {
+		return nil, err
+	}
+	grants := []accessGrant{}
+	for _, entry := range entries {
+		grant := accessGrant{}
+		err = json.Unmarshal(entry.value, &grant)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid grant")
+		}
+		if grant.active(now) {
+			grants = append(grants, grant)
+		}
+	}
+	return grants, nil
+}
+
+// hasGrant reports whether the caller, a member of mspID, holds a grant
+// of the record at key that has not expired
+func hasGrant(stub shim.ChaincodeStubInterface, key, mspID string) (bool, error) {
+	grants, err := activeGrants(stub, key)
+	if err != nil {
+		return false, err
+	}
+	for _, grant := range grants {
+		ok, err := grant.matches(stub, mspID)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
@@ -7,8 +7,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"strings"
+	"strconv"
 
 	"github.com/hyperledger/fabric/bccsp"
 	"github.com/hyperledger/fabric/bccsp/factory"
@@ -22,8 +23,16 @@ const (
 	DECKEY = "DECKEY"
 	// ENCKEY enc key
 	ENCKEY = "ENCKEY"
-	// IV iv
+	// IV iv, optional: a random one is generated for every write unless
+	// deterministic ciphertexts are needed, e.g. in tests
 	IV = "IV"
+	// SIGKEY sig key
+	SIGKEY = "SIGKEY"
+	// VERKEY ver key
+	VERKEY = "VERKEY"
+	// RECORD record of a private data collection, passed through the
+	// transient field so that it stays out of the transaction
+	RECORD = "RECORD"
 )
 
 // SimpleAsset implements a simple chaincode to manage an asset
@@ -33,10 +42,17 @@ type SimpleAsset struct {
 
 // Init is called during chaincode instantiation to initialize any
 // data. Note that chaincode upgrade also calls this function to reset
-// or to migrate data.
+// or to migrate data. An optional JSON configuration may be passed as
+// the first argument, overriding the settings it names; without it the
+// stored configuration is kept. The records stored under legacy keys are
+// moved to composite keys if the second argument is "migrate".
 func (t *SimpleAsset) Init(stub shim.ChaincodeStubInterface) peer.Response {
-	// do nothing
-	return shim.Success(nil)
+	_, args := stub.GetFunctionAndParameters()
+	result, err := initChaincode(stub, args)
+	if err != nil {
+		return fail(errorCode(err), err)
+	}
+	return respond(codeOK, result)
 }
 
 // Invoke is called per transaction on the chaincode. Each transaction is
@@ -47,7 +63,11 @@ func (t *SimpleAsset) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
 	fn, args := stub.GetFunctionAndParameters()
 	tMap, err := stub.GetTransient()
 	if err != nil {
-		return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
+		return fail(codeInternal, fmt.Errorf("Could not retrieve transient, err %s", err))
+	}
+	err = checkTransientSize(stub, tMap)
+	if err != nil {
+		return fail(errorCode(err), err)
 	}
 
 	var result string
@@ -55,6 +75,51 @@ func (t *SimpleAsset) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
 	case "addRecord":
 		result, err = addRecord(stub, args)
 		break
+	case "addRecords":
+		result, err = addRecords(stub, args)
+		break
+	case "encRecords":
+		if _, in := tMap[ENCKEY]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient encryption key %s", ENCKEY))
+		}
+		result, err = t.encRecords(stub, args, tMap[ENCKEY])
+		break
+	case "addRecordsLenient":
+		result, err = addRecordsLenient(stub, args)
+		break
+	case "createRecord":
+		result, err = createRecord(stub, args)
+		break
+	case "updateRecord":
+		result, err = updateRecord(stub, args)
+		break
+	case "deleteRecord":
+		result, err = deleteRecord(stub, args)
+		break
+	case "revokeRecord":
+		result, err = revokeRecord(stub, args)
+		break
+	case "appendEntry":
+		result, err = appendEntry(stub, args)
+		break
+	case "revokeEntry":
+		result, err = revokeEntry(stub, args)
+		break
+	case "getCV":
+		result, err = getCV(stub, args)
+		break
+	case "cloneRecord":
+		result, err = cloneRecord(stub, args)
+		break
+	case "nextSequence":
+		result, err = nextSequence(stub, args)
+		break
+	case "snapshotRecord":
+		result, err = snapshotRecord(stub, args)
+		break
+	case "restoreSnapshot":
+		result, err = restoreSnapshot(stub, args)
+		break
 	case "getRecord":
 		result, err = getRecord(stub, args)
 		break
@@ -62,7 +127,7 @@ func (t *SimpleAsset) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
 		// make sure there's a key in transient - the assumption is that
 		// it's associated to the string "ENCKEY"
 		if _, in := tMap[ENCKEY]; !in {
-			return shim.Error(fmt.Sprintf("Expected transient encryption key %s", ENCKEY))
+			return fail(codeBadRequest, fmt.Errorf("Expected transient encryption key %s", ENCKEY))
 		}
 		result, err = t.Encrypter(stub, args[0:], tMap[ENCKEY], tMap[IV])
 		break
@@ -70,101 +135,777 @@ func (t *SimpleAsset) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
 		// make sure there's a key in transient - the assumption is that
 		// it's associated to the string "DECKEY"
 		if _, in := tMap[DECKEY]; !in {
-			return shim.Error(fmt.Sprintf("Expected transient decryption key %s", DECKEY))
+			return fail(codeBadRequest, fmt.Errorf("Expected transient decryption key %s", DECKEY))
 		}
 		result, err = t.Decrypter(stub, args[0:], tMap[DECKEY], tMap[IV])
 		break
+	case "encryptSignRecord":
+		if _, in := tMap[ENCKEY]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient encryption key %s", ENCKEY))
+		}
+		if _, in := tMap[SIGKEY]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient signing key %s", SIGKEY))
+		}
+		result, err = t.encryptSignRecord(stub, args, tMap[ENCKEY], tMap[IV], tMap[SIGKEY])
+		break
+	case "decryptVerifyRecord":
+		if _, in := tMap[DECKEY]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient decryption key %s", DECKEY))
+		}
+		if _, in := tMap[VERKEY]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient verification key %s", VERKEY))
+		}
+		result, err = t.decryptVerifyRecord(stub, args, tMap[DECKEY], tMap[VERKEY])
+		break
+	case "addPrivateRecord":
+		if _, in := tMap[RECORD]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient record %s", RECORD))
+		}
+		result, err = t.addPrivateRecord(stub, args, tMap[RECORD])
+		break
+	case "getPrivateRecord":
+		result, err = getPrivateRecord(stub, args)
+		break
+	case "verifyPrivateRecord":
+		result, err = t.verifyPrivateRecord(stub, args)
+		break
+	case "encSignRecord":
+		if _, in := tMap[ENCKEY]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient encryption key %s", ENCKEY))
+		}
+		if _, in := tMap[SIGKEY]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient signing key %s", SIGKEY))
+		}
+		result, err = t.encSignRecord(stub, args, tMap[ENCKEY], tMap[SIGKEY])
+		break
+	case "decVerifyRecord":
+		if _, in := tMap[DECKEY]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient decryption key %s", DECKEY))
+		}
+		if _, in := tMap[VERKEY]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient verification key %s", VERKEY))
+		}
+		result, err = t.decVerifyRecord(stub, args, tMap[DECKEY], tMap[VERKEY])
+		break
+	case "signRecord":
+		if _, in := tMap[SIGKEY]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient signing key %s", SIGKEY))
+		}
+		result, err = t.signRecord(stub, args, tMap[SIGKEY])
+		break
+	case "verifyRecord":
+		// with a candidate, the record is checked against it rather than
+		// against its signature
+		if len(args) == 3 {
+			result, err = t.verifyRecordValue(stub, args)
+			break
+		}
+		if _, in := tMap[VERKEY]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient verification key %s", VERKEY))
+		}
+		result, err = t.verifyRecord(stub, args, tMap[VERKEY])
+		break
+	case "verifyAllSignatures":
+		if _, in := tMap[VERKEY]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient verification key %s", VERKEY))
+		}
+		result, err = t.verifyAllSignatures(stub, args, tMap[VERKEY])
+		break
+	case "scanWithCursor":
+		result, err = scanWithCursor(stub, args)
+		break
+	case "getRecordsByRange":
+		// with an object type, a page of a single namespace is returned
+		if len(args) == 4 || len(args) == 5 {
+			result, err = t.getNamespacePage(stub, args, tMap[DECKEY])
+			break
+		}
+		result, err = getRecordsByRange(stub, args)
+		break
+	case "getRecordsByRangePaginated":
+		result, err = getRecordsByRangePaginated(stub, args)
+		break
+	case "queryRecords":
+		result, err = queryRecords(stub, args)
+		break
+	case "listRecords":
+		result, err = listRecords(stub, args)
+		break
+	case "listRecordsByOwner":
+		result, err = listRecordsByOwner(stub, args)
+		break
+	case "getRecordsByRangeNDJSON":
+		result, err = getRecordsByRangeNDJSON(stub, args)
+		break
+	case "getRecordWithNeighbors":
+		result, err = getRecordWithNeighbors(stub, args)
+		break
+	case "getRecordWithProof":
+		result, err = t.getRecordWithProof(stub, args)
+		break
+	case "detectKeyCollisions":
+		result, err = detectKeyCollisions(stub)
+		break
+	case "exportSignedBundle":
+		if _, in := tMap[SIGKEY]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient signing key %s", SIGKEY))
+		}
+		result, err = t.exportSignedBundle(stub, args, tMap[SIGKEY])
+		break
+	case "getRecordsModifiedBy":
+		result, err = getRecordsModifiedBy(stub, args)
+		break
+	case "getHistory":
+		result, err = getHistory(stub, args)
+		break
+	case "getRecordHistory":
+		result, err = getRecordHistory(stub, args)
+		break
+	case "getRecordAsOf":
+		result, err = getRecordAsOf(stub, args)
+		break
+	case "hotRecords":
+		result, err = hotRecords(stub, args)
+		break
+	case "verifyCommitment":
+		result, err = t.verifyCommitment(stub, args)
+		break
+	case "grantAccess":
+		result, err = grantAccess(stub, args)
+		break
+	case "revokeAccess":
+		result, err = revokeAccess(stub, args)
+		break
+	case "listGrants":
+		result, err = listGrants(stub, args)
+		break
+	case "getConfig":
+		result, err = getEffectiveConfig(stub, args)
+		break
+	case "instantiatedAt":
+		result, err = instantiatedAt(stub)
+		break
+	case "encryptionByOwnerReport":
+		result, err = encryptionByOwnerReport(stub)
+		break
+	case "indexOverheadReport":
+		result, err = indexOverheadReport(stub)
+		break
+	case "canonicalDump":
+		result, err = canonicalDump(stub, args)
+		break
+	case "namespaceDigest":
+		result, err = t.namespaceDigest(stub, args)
+		break
+	case "storageByOwner":
+		result, err = storageByOwner(stub)
+		break
+	case "setIssuerOrgs":
+		result, err = setIssuerOrgs(stub, args)
+		break
+	case "setOwnerQuota":
+		result, err = setOwnerQuota(stub, args)
+		break
+	case "setOwnerRecordLimit":
+		result, err = setOwnerRecordLimit(stub, args)
+		break
+	case "benchmarkWrite":
+		result, err = benchmarkWrite(stub, args)
+		break
+	case "verifyAllDecryptable":
+		if _, in := tMap[DECKEY]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient decryption key %s", DECKEY))
+		}
+		result, err = t.verifyAllDecryptable(stub, tMap[DECKEY])
+		break
+	case "verifyIVIntegrity":
+		result, err = verifyIVIntegrity(stub)
+		break
+	case "requiredKeyFingerprint":
+		result, err = requiredKeyFingerprint(stub, args)
+		break
+	case "listRecordsForRekey":
+		result, err = listRecordsForRekey(stub, args)
+		break
+	case "reEncryptRecord":
+		if _, in := tMap[DECKEY]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient decryption key %s", DECKEY))
+		}
+		if _, in := tMap[ENCKEY]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient encryption key %s", ENCKEY))
+		}
+		result, err = t.reEncryptRecord(stub, args, tMap[DECKEY], tMap[ENCKEY], tMap[IV])
+		break
+	case "reEncryptRange":
+		if _, in := tMap[DECKEY]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient decryption key %s", DECKEY))
+		}
+		if _, in := tMap[ENCKEY]; !in {
+			return fail(codeBadRequest, fmt.Errorf("Expected transient encryption key %s", ENCKEY))
+		}
+		result, err = t.reEncryptRange(stub, args, tMap[DECKEY], tMap[ENCKEY])
+		break
 	default:
-		return shim.Error(fmt.Sprintf("Unsupported function %s", fn))
+		return fail(codeBadRequest, fmt.Errorf("Unsupported function %s", fn))
 	}
 	if err != nil {
-		return shim.Error(err.Error())
+		return fail(errorCode(err), err)
 	}
-	return shim.Success([]byte(result))
+	return respond(codeOK, result)
 }
 
-// addRecord stores the asset (both key and value) on the ledger. If the key exists,
-// it will override the value with the new one
+// addRecord is a deprecated alias of createRecord. It used to override the
+// value of an existing key, which updateRecord now does under version
+// checks; old clients get an error instead of silently overwriting data
 func addRecord(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	return createRecord(stub, args)
+}
+
+// createRecord stores the asset (both key and value) on the ledger, only if
+// the key does not exist yet; an existing value is never overridden. The value
+// is the json Record in args[2], stored as version 1; the stored document is
+// returned so that the caller can confirm what was written
+func createRecord(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	value, event, err := putRecord(stub, args, checkOwnerQuota)
+	if err != nil {
+		return "", err
+	}
+	err = emitEvent(stub, event)
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// putRecord writes the record of createRecord, whose storage is checked
+// with quota, and returns, along with the stored document, the event of
+// the write for the caller to emit
+func putRecord(stub shim.ChaincodeStubInterface, args []string, quota func(stub shim.ChaincodeStubInterface, key string, size int) error) (string, recordEvent, error) {
+	if len(args) != 3 {
+		return "", recordEvent{}, errorf(codeBadRequest, "Incorrect arguments. Expecting a key and a record")
+	}
+	err := checkPlaintextAllowed(stub)
+	if err != nil {
+		return "", recordEvent{}, err
+	}
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", recordEvent{}, err
+	}
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return "", recordEvent{}, fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	if existing != nil {
+		return "", recordEvent{}, errorf(codeConflict, "Asset already exists: %s", key)
+	}
+	value, err := makeRecord(stub, key, args)
+	if err != nil {
+		return "", recordEvent{}, errorf(codeBadRequest, "Incorrect arguments. %s", err)
+	}
+	err = checkIssuer(stub, value)
+	if err != nil {
+		return "", recordEvent{}, err
+	}
+	err = quota(stub, key, len(value))
+	if err != nil {
+		return "", recordEvent{}, err
+	}
+	err = checkWriter(stub, key)
+	if err != nil {
+		return "", recordEvent{}, err
+	}
+	event, err := newRecordEvent(stub, recordAddedEvent, key)
+	if err != nil {
+		return "", recordEvent{}, err
+	}
+	// the fold index entry is only written once the record is known to
+	// be valid, so that a rejected record writes nothing
+	_, err = resolveKey(stub, args[0], args[1], true)
+	if err != nil {
+		return "", recordEvent{}, err
+	}
+	err = stub.PutState(key, []byte(value))
+	if err != nil {
+		return "", recordEvent{}, fmt.Errorf("Failed to set asset: %s", args[0])
+	}
+	// a deleted record leaves a tombstone behind
+	err = clearRecordMeta(stub, key)
+	if err != nil {
+		return "", recordEvent{}, fmt.Errorf("Failed to set asset: %s", args[0])
+	}
+	err = trackModifier(stub, key)
+	if err != nil {
+		return "", recordEvent{}, fmt.Errorf("Failed to track modifier of asset: %s with error: %s", args[0], err)
+	}
+	return value, event, nil
+}
+
+// updateRecord replaces the json Record of the existing asset at args[0:2]
+// with the one in args[3], provided the stored record is at the version in
+// args[2], so that concurrent updates cannot silently override each other.
+// The version is incremented and the creation time kept; encrypted and
+// revoked records cannot be updated
+func updateRecord(stub shim.ChaincodeStubInterface, args []string) (string, error) {
 	if len(args) != 4 {
-		return "", fmt.Errorf("Incorrect arguments. Expecting a key and a value")
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key, a version and a record")
+	}
+	version, err := strconv.Atoi(args[2])
+	if err != nil || version < 0 {
+		return "", errorf(codeBadRequest, "Invalid version %s", args[2])
 	}
-	key := args[0] + ":" + args[1]
-	value := args[2] + ":" + args[3]
-	err := stub.PutState(key, []byte(value))
+	err = checkPlaintextAllowed(stub)
+	if err != nil {
+		return "", err
+	}
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	stored, err := stub.GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	if stored == nil {
+		return "", errorf(codeNotFound, "Asset not found: %s", args[0])
+	}
+	_, err = parseRecord(stored)
+	if err != nil {
+		return "", fmt.Errorf("Failed to update asset: %s with error: %s", args[0], err)
+	}
+	old := Record{}
+	err = json.Unmarshal(stored, &old)
+	if err != nil {
+		return "", err
+	}
+	if old.Revoked {
+		return "", errorf(codeConflict, "Asset revoked: %s was revoked at %s", args[0], old.RevokedAt)
+	}
+	if old.Version != version {
+		return "", errorf(codeConflict, "Version conflict: %s is at version %d, not %d", args[0], old.Version, version)
+	}
+
+	r, err := newRecord(stub, key, []string{args[0], args[1], args[3]})
+	if err != nil {
+		return "", errorf(codeBadRequest, "Incorrect arguments. %s", err)
+	}
+	r.Version = old.Version + 1
+	r.CreatedAt = old.CreatedAt
+	value, err := r.document()
+	if err != nil {
+		return "", err
+	}
+	err = checkIssuer(stub, value)
+	if err != nil {
+		return "", err
+	}
+	err = checkOwnerQuota(stub, key, len(value))
+	if err != nil {
+		return "", err
+	}
+	err = checkWriter(stub, key)
+	if err != nil {
+		return "", err
+	}
+	event, err := newRecordEvent(stub, recordUpdatedEvent, key)
+	if err != nil {
+		return "", err
+	}
+	err = stub.PutState(key, []byte(value))
+	if err != nil {
+		return "", fmt.Errorf("Failed to set asset: %s", args[0])
+	}
+	err = clearRecordMeta(stub, key)
 	if err != nil {
 		return "", fmt.Errorf("Failed to set asset: %s", args[0])
 	}
+	err = trackModifier(stub, key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to track modifier of asset: %s with error: %s", args[0], err)
+	}
+	err = emitEvent(stub, event)
+	if err != nil {
+		return "", err
+	}
 	return value, nil
 }
 
-// getRecord returns the value of the specified asset key
+// cloneRecord copies the stored value of the asset at args[0:2] to the
+// new key args[2:4], which must not exist yet. The value is copied as is,
+// so an encrypted record stays encrypted under the same key, among the
+// encrypted records, and the owner in the document remains that of the
+// source; the clone is recorded as written by the caller, who must be
+// able to read the source and to write the clone like a new record
+func cloneRecord(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 4 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a source and a target key")
+	}
+	from, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(from)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	if len(value) == 0 {
+		value = nil
+	}
+	// checked before telling whether the record exists
+	err = checkReader(stub, from, args[0], value)
+	if err != nil {
+		return "", err
+	}
+	if value == nil {
+		return "", errorf(codeNotFound, "Asset not found: %s", args[0])
+	}
+
+	to, err := resolveKey(stub, args[2], args[3], true)
+	if err != nil {
+		return "", err
+	}
+	existing, err := stub.GetState(to)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[2], err)
+	}
+	if existing != nil {
+		return "", errorf(codeConflict, "Asset already exists: %s", to)
+	}
+	// the clone of an encrypted record is stored with the encrypted ones
+	encrypted, err := isEncrypted(stub, from)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	to, err = namespaceKey(stub, to, encrypted)
+	if err != nil {
+		return "", fmt.Errorf("Failed to set asset: %s with error: %s", args[2], err)
+	}
+	// the issuer named by an encrypted record cannot be checked, only
+	// that the caller is an issuer
+	if encrypted {
+		_, err = checkIssuerOrg(stub)
+	} else {
+		err = checkIssuer(stub, string(value))
+	}
+	if err != nil {
+		return "", err
+	}
+	err = checkOwnerQuota(stub, to, len(value))
+	if err != nil {
+		return "", err
+	}
+	err = checkWriter(stub, to)
+	if err != nil {
+		return "", err
+	}
+
+	event, err := newRecordEvent(stub, recordAddedEvent, to)
+	if err != nil {
+		return "", err
+	}
+	err = stub.PutState(to, value)
+	if err != nil {
+		return "", fmt.Errorf("Failed to set asset: %s", args[2])
+	}
+	err = copyRecordMeta(stub, from, to)
+	if err != nil {
+		return "", fmt.Errorf("Failed to set asset: %s", args[2])
+	}
+	err = trackModifier(stub, to)
+	if err != nil {
+		return "", fmt.Errorf("Failed to track modifier of asset: %s with error: %s", args[2], err)
+	}
+	err = emitEvent(stub, event)
+	if err != nil {
+		return "", err
+	}
+	return to, nil
+}
+
+// deleteRecord removes the asset and everything kept about it from the
+// ledger, leaving only a tombstone, and returns the deleted value; only
+// the identity that created it may delete it and, once issuer
+// organizations are configured, only from its issuer organization
+func deleteRecord(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key")
+	}
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	if value == nil {
+		return "", errorf(codeNotFound, "Asset not found: %s", args[0])
+	}
+	err = checkRecordIssuer(stub, value)
+	if err != nil {
+		return "", err
+	}
+	err = checkWriter(stub, key)
+	if err != nil {
+		return "", err
+	}
+
+	err = stub.DelState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to delete asset: %s", args[0])
+	}
+	err = clearRecordMeta(stub, key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to delete asset: %s with error: %s", args[0], err)
+	}
+	err = clearIdentities(stub, key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to delete asset: %s with error: %s", args[0], err)
+	}
+	err = clearFoldKey(stub, key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to delete asset: %s with error: %s", args[0], err)
+	}
+	// a snapshot would let anyone bring the record back as their own
+	err = deleteIndexEntries(stub, snapIndex, key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to delete asset: %s with error: %s", args[0], err)
+	}
+	// nor should a grant outlive the record it was given for
+	err = deleteIndexEntries(stub, grantIndex, key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to delete asset: %s with error: %s", args[0], err)
+	}
+	err = markDeleted(stub, key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to delete asset: %s with error: %s", args[0], err)
+	}
+	event, err := newRecordEvent(stub, recordDeletedEvent, key)
+	if err != nil {
+		return "", err
+	}
+	err = emitEvent(stub, event)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// getRecord returns the whole json document of the specified asset key. A
+// revoked record is returned with its revocation, while a deleted record
+// is reported as such rather than as not found and a missing one with
+// the ids it was looked up by
 func getRecord(stub shim.ChaincodeStubInterface, args []string) (string, error) {
 	if len(args) != 2 {
-		return "", fmt.Errorf("Incorrect arguments. Expecting a key")
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key")
 	}
 
-	key := args[0] + ":" + args[1]
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
 	value, err := stub.GetState(key)
-	result := strings.Split(string(value), ":")
 	if err != nil {
 		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
 	}
+	// the peer treats an empty value as a deleted one
+	if len(value) == 0 {
+		value = nil
+	}
+	// checked before telling whether the record exists
+	err = checkReader(stub, key, args[0], value)
+	if err != nil {
+		return "", err
+	}
 	if value == nil {
-		return "", fmt.Errorf("Asset not found: %s", args[0])
+		deleted, err := getTombstone(stub, key)
+		if err != nil {
+			return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+		}
+		if deleted != nil {
+			return "", errorf(codeNotFound, "Asset deleted: %s was deleted at %s", args[0], deleted.DeletedAt)
+		}
+		return "", errorf(codeNotFound, "Asset not found: record not found for key %s", legacyKey(args[0], args[1]))
 	}
-	return result[0], nil
+	result, err := parseRecord(value)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	return result, nil
 }
 
 // Encrypter exposes how to write state to the ledger after having
 // encrypted it with an AES 256 bit key that has been provided to the chaincode through the
-// transient field
+// transient field. Unless an IV is supplied as well, the bccsp instance generates a random
+// one for every write; either way it is stored as the first block of the ciphertext. Note
+// that endorsers generating their own IVs produce different ciphertexts, so a fixed IV is
+// needed when the endorsement policy requires more than one peer
 func (t *SimpleAsset) Encrypter(stub shim.ChaincodeStubInterface, args []string, encKey, IV []byte) (string, error) {
 	// create the encrypter entity - we give it an ID, the bccsp instance, the key and (optionally) the IV
 	ent, err := entities.NewAES256EncrypterEntity("ID", t.bccspInst, encKey, IV)
 	if err != nil {
-		return "", fmt.Errorf("entities.NewAES256EncrypterEntity failed, err %s", err)
+		return "", errorf(codeCryptoError, "entities.NewAES256EncrypterEntity failed, err %s", err)
 	}
 
-	if len(args) != 4 {
-		return "", fmt.Errorf("Expected 4 parameters to function Encrypter")
+	if len(args) != 3 {
+		return "", errorf(codeBadRequest, "Expected 3 parameters to function Encrypter")
 	}
+	value, event, err := t.putEncrypted(stub, encKey, args, encryptValue(ent))
+	if err != nil {
+		return "", err
+	}
+	err = emitEvent(stub, event)
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
 
-	key := args[0] + ":" + args[1]
-	value := args[2] + ":" + args[3]
-	cleartextValue := []byte(value)
+// putEncrypted writes the record of Encrypter, encrypted under encKey,
+// and returns the cleartext document and the event of the write for the
+// caller to emit. The value stored is the one seal returns for the
+// document and the key it is written to: its ciphertext, possibly along
+// with a signature
+func (t *SimpleAsset) putEncrypted(stub shim.ChaincodeStubInterface, encKey []byte, args []string, seal func(key, value string) ([]byte, error)) (string, recordEvent, error) {
+	key, err := resolveKey(stub, args[0], args[1], true)
+	if err != nil {
+		return "", recordEvent{}, err
+	}
+	value, err := makeRecord(stub, key, args)
+	if err != nil {
+		return "", recordEvent{}, errorf(codeBadRequest, "Incorrect arguments. %s", err)
+	}
+	err = checkIssuer(stub, value)
+	if err != nil {
+		return "", recordEvent{}, err
+	}
+	err = checkNotRevoked(stub, key)
+	if err != nil {
+		return "", recordEvent{}, err
+	}
+	err = checkWriter(stub, key)
+	if err != nil {
+		return "", recordEvent{}, err
+	}
+	event, err := newWriteEvent(stub, key)
+	if err != nil {
+		return "", recordEvent{}, fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	event.Encrypted = true
 
-	// here, we encrypt cleartextValue and assign it to key
-	err = encryptAndPutState(stub, ent, key, cleartextValue)
+	// encrypted records are kept apart from plaintext ones
+	key, err = namespaceKey(stub, key, true)
 	if err != nil {
-		return "", fmt.Errorf("encryptAndPutState failed, err %+v", err)
+		return "", recordEvent{}, fmt.Errorf("Failed to set asset: %s with error: %s", args[0], err)
+	}
+	stored, err := seal(key, value)
+	if err != nil {
+		return "", recordEvent{}, err
+	}
+	err = checkOwnerQuota(stub, key, len(stored))
+	if err != nil {
+		return "", recordEvent{}, err
+	}
+	err = stub.PutState(key, stored)
+	if err != nil {
+		return "", recordEvent{}, fmt.Errorf("Failed to set asset: %s", args[0])
+	}
+
+	// and we keep track of the key the record is encrypted under
+	err = t.trackEncrypted(stub, key, encKey, []byte(value))
+	if err != nil {
+		return "", recordEvent{}, fmt.Errorf("trackEncrypted failed, err %+v", err)
+	}
+	// so that the record can be verified without the key
+	err = t.putDigest(stub, key, value)
+	if err != nil {
+		return "", recordEvent{}, fmt.Errorf("putDigest failed, err %+v", err)
+	}
+	err = trackModifier(stub, key)
+	if err != nil {
+		return "", recordEvent{}, fmt.Errorf("trackModifier failed, err %+v", err)
+	}
+	return value, event, nil
+}
+
+// encryptValue returns the seal of putEncrypted encrypting the document
+// with the supplied entity
+func encryptValue(ent entities.Encrypter) func(key, value string) ([]byte, error) {
+	return func(key, value string) ([]byte, error) {
+		ciphertext, err := ent.Encrypt([]byte(value))
+		if err != nil {
+			return nil, errorf(codeCryptoError, "Encrypt failed, err %s", err)
+		}
+		return ciphertext, nil
 	}
-	return value, nil
 }
 
 // Decrypter exposes how to read from the ledger and decrypt using an AES 256
 // bit key that has been provided to the chaincode through the transient field.
+// The IV is read back from the ciphertext, so none needs to be supplied
 func (t *SimpleAsset) Decrypter(stub shim.ChaincodeStubInterface, args []string, decKey, IV []byte) (string, error) {
 	// create the encrypter entity - we give it an ID, the bccsp instance, the key and (optionally) the IV
 	ent, err := entities.NewAES256EncrypterEntity("ID", t.bccspInst, decKey, IV)
 	if err != nil {
-		return "", fmt.Errorf("entities.NewAES256EncrypterEntity failed, err %s", err)
+		return "", errorf(codeCryptoError, "entities.NewAES256EncrypterEntity failed, err %s", err)
 	}
 
 	if len(args) != 2 {
-		return "", fmt.Errorf("Expected 2 parameters to function Decrypter")
+		return "", errorf(codeBadRequest, "Expected 2 parameters to function Decrypter")
+	}
+
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	// a missing record and a wrong key are told apart before decrypting
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	if len(value) == 0 {
+		value = nil
+	}
+	// checked before telling whether the record exists
+	err = checkReader(stub, key, args[0], value)
+	if err != nil {
+		return "", err
+	}
+	if value == nil {
+		return "", errorf(codeNotFound, "Asset not found: record not found for key %s", legacyKey(args[0], args[1]))
+	}
+	indexKey, err := recordIndexKey(stub, encIndex, key)
+	if err != nil {
+		return "", err
+	}
+	fingerprint, err := stub.GetState(indexKey)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	if fingerprint != nil {
+		decFingerprint, err := t.keyFingerprint(decKey)
+		if err != nil {
+			return "", err
+		}
+		if string(fingerprint) != decFingerprint {
+			return "", errorf(codeCryptoError, "Asset %s is encrypted under a different key", args[0])
+		}
 	}
 
-	key := args[0] + ":" + args[1]
 	// here we decrypt the state associated to key
 	cleartextValue, err := getStateAndDecrypt(stub, ent, key)
 	if err != nil {
-		return "", fmt.Errorf("getStateAndDecrypt failed, err %+v", err)
+		return "", errorf(codeCryptoError, "getStateAndDecrypt failed, err %+v", err)
 	}
 
-	result := strings.Split(string(cleartextValue), ":")
+	// a record encrypted before fingerprints were kept may still decrypt
+	// under a wrong key, into garbage
+	result, err := parseRecord(cleartextValue)
+	if err != nil {
+		return "", errorf(codeCryptoError, "Failed to get asset: %s with error: %s", args[0], err)
+	}
 	// here we return the decrypted value as a result
-	return result[0], nil
+	return result, nil
 }
 
 // main function starts up the chaincode in the container during instantiate
@@ -0,0 +1,225 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/bccsp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/pkg/errors"
+)
+
+// digestIndex is the composite key object type under which the hex
+// encoded SHA-256 of the document of an encrypted record is stored, so
+// that the record can be verified without its key. The digest is a plain
+// hash: a record whose every field can be guessed can be found out from it
+const digestIndex = "digest"
+
+type recordVerification struct {
+	Key      string `json:"key"`
+	Exists   bool   `json:"exists"`
+	Match    bool   `json:"match"`
+	IssuedAt string `json:"issuedAt,omitempty"`
+	Revoked  bool   `json:"revoked"`
+}
+
+// documentDigest returns the hex encoded SHA-256 of a record document
+func (t *SimpleAsset) documentDigest(value []byte) (string, error) {
+	h, err := t.bccspInst.Hash(value, &bccsp.SHA256Opts{})
+	if err != nil {
+		return "", fmt.Errorf("bccspInst.Hash failed, err %s", err)
+	}
+	return hex.EncodeToString(h), nil
+}
+
+// putDigest stores the digest of value, the document of the record at key
+// that has just been written encrypted
+func (t *SimpleAsset) putDigest(stub shim.ChaincodeStubInterface, key, value string) error {
+	digest, err := t.documentDigest([]byte(value))
+	if err != nil {
+		return err
+	}
+	indexKey, err := recordIndexKey(stub, digestIndex, key)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(indexKey, []byte(digest))
+}
+
+// isDigest reports whether candidate is a hex encoded SHA-256 rather than
+// a document, which cannot be made of hex digits only
+func isDigest(candidate string) bool {
+	_, err := hex.DecodeString(candidate)
+	return err == nil && len(candidate) == 2*32
+}
+
+// verifyRecordValue reports whether the candidate in args[2], either the
+// document of the record at args[0:2] exactly as returned by getRecord or
+// decRecord, or its hex encoded SHA-256, matches the stored record. An
+// encrypted record is checked against the digest stored when it was
+// written, so no key is needed. The stored value is never returned: the
+// issuance time and revocation are only reported for a matching
+// candidate, and for an encrypted record the issuance time is read from
+// the candidate document. Being read-only, it is meant for queries
+func (t *SimpleAsset) verifyRecordValue(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 3 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key and a candidate record or digest")
+	}
+	candidate := args[2]
+	digest := strings.ToLower(candidate)
+	if !isDigest(candidate) {
+		var err error
+		digest, err = t.documentDigest([]byte(candidate))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	result := recordVerification{Key: key, Exists: value != nil}
+	if value != nil {
+		result.Match, result.IssuedAt, result.Revoked, err = t.matchRecord(stub, key, value, digest, candidate)
+		if err != nil {
+			return "", fmt.Errorf("Failed to verify asset: %s with error: %s", args[0], err)
+		}
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// matchRecord compares digest, that of candidate, with the stored value of
+// the record at key and, if they match, returns the issuance time and
+// revocation of the record
+func (t *SimpleAsset) matchRecord(stub shim.ChaincodeStubInterface, key string, value []byte, digest, candidate string) (bool, string, bool, error) {
+	encrypted, err := isEncrypted(stub, key)
+	if err != nil {
+		return false, "", false, err
+	}
+	if encrypted {
+		indexKey, err := recordIndexKey(stub, digestIndex, key)
+		if err != nil {
+			return false, "", false, err
+		}
+		stored, err := stub.GetState(indexKey)
+		if err != nil {
+			return false, "", false, err
+		}
+		if stored == nil {
+			return false, "", false, errors.New("the record is encrypted and was written without a digest, it has to be written again to be verified")
+		}
+		if string(stored) != digest {
+			return false, "", false, nil
+		}
+		// records are revoked in plaintext only
+		r := Record{}
+		if json.Unmarshal([]byte(candidate), &r) != nil {
+			return true, "", false, nil
+		}
+		return true, r.IssuedAt, false, nil
+	}
+
+	document, err := parseRecord(value)
+	if err != nil {
+		return false, "", false, err
+	}
+	stored, err := t.documentDigest([]byte(document))
+	if err != nil {
+		return false, "", false, err
+	}
+	if stored != digest {
+		return false, "", false, nil
+	}
+	r := Record{}
+	err = json.Unmarshal([]byte(document), &r)
+	if err != nil {
+		return false, "", false, err
+	}
+	return true, r.IssuedAt, r.Revoked, nil
+}
+
+// isEncrypted reports whether the record at key is stored encrypted
+func isEncrypted(stub shim.ChaincodeStubInterface, key string) (bool, error) {
+	indexKey, err := recordIndexKey(stub, encIndex, key)
+	if err != nil {
+		return false, err
+	}
+	fingerprint, err := stub.GetState(indexKey)
+	if err != nil {
+		return false, err
+	}
+	return fingerprint != nil, nil
+}
+
+type recordProof struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+	// TxID is the ID of the transaction that last wrote Value
+	TxID   string `json:"txId"`
+	Digest string `json:"digest"`
+}
+
+// getRecordWithProof returns the raw stored value of a record together
+// with the ID of the transaction that last wrote it and the hex encoded
+// SHA-256 of the value, so that an off-chain party can look the write up
+// in the block of that transaction and compare the hashes. It is not an
+// attestation: the chaincode holds no key to sign with, and the response
+// is only as trustworthy as the peer that returns it
+func (t *SimpleAsset) getRecordWithProof(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key")
+	}
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	// the peer treats an empty value as a deleted one
+	if len(value) == 0 {
+		value = nil
+	}
+	// checked before telling whether the record exists
+	err = checkReader(stub, key, args[0], value)
+	if err != nil {
+		return "", err
+	}
+	if value == nil {
+		return "", errorf(codeNotFound, "Asset not found: %s", args[0])
+	}
+
+	txID, err := lastWriteTxID(stub, key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get history of asset: %s with error: %s", args[0], err)
+	}
+	digest, err := t.documentDigest(value)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(recordProof{key, value, txID, digest})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
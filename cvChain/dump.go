@@ -0,0 +1,152 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/bccsp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// dumpEntry is a key of the namespace with its value, given as canonical
+// json if the value is json and as raw bytes otherwise
+type dumpEntry struct {
+	Key   string          `json:"key"`
+	JSON  json.RawMessage `json:"json,omitempty"`
+	Bytes []byte          `json:"bytes,omitempty"`
+}
+
+// canonicalJSON re-encodes a json value with sorted object keys and no
+// insignificant whitespace, keeping numbers as they were written. It
+// returns false if value is not a single json value
+func canonicalJSON(value []byte) ([]byte, bool) {
+	d := json.NewDecoder(bytes.NewReader(value))
+	d.UseNumber()
+	var v interface{}
+	if d.Decode(&v) != nil || d.More() {
+		return nil, false
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// dumpState returns the canonical serialization of every key of the
+// namespace: the simple keys and the composite keys of all the object
+// types the chaincode writes, sorted by key
+func dumpState(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	state := map[string][]byte{}
+
+	iterator, err := stub.GetStateByRange("", maxKey)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+	for iterator.HasNext() {
+		el, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		// composite keys are read by object type below
+		if !strings.HasPrefix(el.Key, "\x00") {
+			state[el.Key] = el.Value
+		}
+	}
+
+	// range queries do not return composite keys, so they are gathered
+	// from every object type
+	for _, objectType := range append(append([]string{}, recordIndexes...), indexes...) {
+		iterator, err := stub.GetStateByPartialCompositeKey(objectType, []string{})
+		if err != nil {
+			return nil, err
+		}
+		defer iterator.Close()
+		for iterator.HasNext() {
+			el, err := iterator.Next()
+			if err != nil {
+				return nil, err
+			}
+			state[el.Key] = el.Value
+		}
+	}
+
+	keys := make([]string, 0, len(state))
+	for key := range state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	entries := make([]dumpEntry, 0, len(keys))
+	for _, key := range keys {
+		entry := dumpEntry{Key: key}
+		if b, ok := canonicalJSON(state[key]); ok {
+			entry.JSON = b
+		} else {
+			entry.Bytes = state[key]
+		}
+		entries = append(entries, entry)
+	}
+	return json.Marshal(entries)
+}
+
+// canonicalDump returns a byte-for-byte deterministic serialization of the
+// whole namespace of the chaincode, so that peers or environments can
+// reconcile their state by comparing dumps. It returns every record
+// regardless of who may read it, so only the admin may call it. Being a
+// full scan, it is meant for read-only queries
+func canonicalDump(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 0 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting no arguments")
+	}
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return "", err
+	}
+	err = requireAdmin(stub, cfg)
+	if err != nil {
+		return "", err
+	}
+	b, err := dumpState(stub)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// namespaceDigest returns the hex encoded SHA-256 of the canonical dump,
+// to compare namespaces without transferring their contents. Like the
+// dump, it is restricted to the admin
+func (t *SimpleAsset) namespaceDigest(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 0 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting no arguments")
+	}
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return "", err
+	}
+	err = requireAdmin(stub, cfg)
+	if err != nil {
+		return "", err
+	}
+	b, err := dumpState(stub)
+	if err != nil {
+		return "", err
+	}
+	h, err := t.bccspInst.Hash(b, &bccsp.SHA256Opts{})
+	if err != nil {
+		return "", fmt.Errorf("bccspInst.Hash failed, err %s", err)
+	}
+	return hex.EncodeToString(h), nil
+}
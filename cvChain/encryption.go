@@ -0,0 +1,407 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/hyperledger/fabric/bccsp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/entities"
+	"github.com/pkg/errors"
+)
+
+const (
+	// encIndex is the composite key object type of the index that marks
+	// encrypted records; the value of each entry is the fingerprint of the
+	// key the record was encrypted with
+	encIndex = "enc"
+	// escrowIndex is the composite key object type under which the key of
+	// an encrypted record is stored, wrapped for the escrow
+	escrowIndex = "escrow"
+	// issuerIndex is the composite key object type under which the issuer
+	// MSP named by an encrypted record is stored, for checkReader to tell
+	// without decrypting the record
+	issuerIndex = "issuer"
+)
+
+// recordMetaIndexes lists the indexes holding metadata about the stored
+// value of a record, which only applies as long as the value is unchanged
+var recordMetaIndexes = []string{encIndex, escrowIndex, issuerIndex, sigIndex, deletedIndex, digestIndex}
+
+// keyFingerprint returns the hex encoded SHA-256 of the supplied key,
+// which identifies the key without revealing it
+func (t *SimpleAsset) keyFingerprint(key []byte) (string, error) {
+	h, err := t.bccspInst.Hash(key, &bccsp.SHA256Opts{})
+	if err != nil {
+		return "", errors.WithMessage(err, "could not hash key")
+	}
+	return hex.EncodeToString(h), nil
+}
+
+// markEncrypted records that key holds a value encrypted under the key
+// with the supplied fingerprint
+func markEncrypted(stub shim.ChaincodeStubInterface, key, fingerprint string) error {
+	indexKey, err := recordIndexKey(stub, encIndex, key)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(indexKey, []byte(fingerprint))
+}
+
+// clearRecordMeta drops the metadata kept about the previous value of
+// key, which no longer applies once the record is overwritten
+func clearRecordMeta(stub shim.ChaincodeStubInterface, key string) error {
+	for _, index := range recordMetaIndexes {
+		indexKey, err := recordIndexKey(stub, index, key)
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(indexKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyRecordMeta copies the metadata kept about the value of from over
+// to to, for a record that has been written with the same value
+func copyRecordMeta(stub shim.ChaincodeStubInterface, from, to string) error {
+	for _, index := range recordMetaIndexes {
+		fromKey, err := recordIndexKey(stub, index, from)
+		if err != nil {
+			return err
+		}
+		toKey, err := recordIndexKey(stub, index, to)
+		if err != nil {
+			return err
+		}
+		meta, err := stub.GetState(fromKey)
+		if err != nil {
+			return err
+		}
+		if meta == nil {
+			err = stub.DelState(toKey)
+		} else {
+			err = stub.PutState(toKey, meta)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trackEncrypted updates the metadata of the record at key once its
+// document doc has been written encrypted under encKey: the metadata of
+// the previous value is dropped, the record is marked as encrypted, its
+// issuer is recorded and its key is escrowed
+func (t *SimpleAsset) trackEncrypted(stub shim.ChaincodeStubInterface, key string, encKey, doc []byte) error {
+	err := clearRecordMeta(stub, key)
+	if err != nil {
+		return err
+	}
+
+	fingerprint, err := t.keyFingerprint(encKey)
+	if err != nil {
+		return err
+	}
+	err = markEncrypted(stub, key, fingerprint)
+	if err != nil {
+		return errors.WithMessage(err, "markEncrypted failed")
+	}
+	r := Record{}
+	err = json.Unmarshal(doc, &r)
+	if err != nil {
+		return errors.WithMessage(err, "invalid record")
+	}
+	indexKey, err := recordIndexKey(stub, issuerIndex, key)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(indexKey, []byte(r.Issuer))
+	if err != nil {
+		return err
+	}
+
+	// the write is rejected unless the key can be escrowed
+	err = escrowKey(stub, key, encKey)
+	if err != nil {
+		return errors.WithMessage(err, "escrowKey failed")
+	}
+	return nil
+}
+
+// wrapForEscrow encrypts encKey with RSA-OAEP under the supplied PEM
+// encoded escrow public key. The bccsp only offers symmetric encryption,
+// hence the use of crypto/rsa. Like a random IV, OAEP padding is random,
+// so endorsers produce different wrapped keys for the same write
+func wrapForEscrow(escrowKey string, encKey []byte) ([]byte, error) {
+	rsaPub, err := parseEscrowKey(escrowKey)
+	if err != nil {
+		return nil, err
+	}
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPub, encKey, []byte(escrowIndex))
+}
+
+// parseEscrowKey parses the PEM encoded RSA public key of the escrow
+func parseEscrowKey(escrowKey string) (*rsa.PublicKey, error) {
+	bl, _ := pem.Decode([]byte(escrowKey))
+	if bl == nil {
+		return nil, errors.New("pem.Decode returns nil")
+	}
+	pub, err := x509.ParsePKIXPublicKey(bl.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse escrow public key")
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("escrow public key is not an RSA key")
+	}
+	return rsaPub, nil
+}
+
+// escrowKey stores encKey, wrapped for the escrow configured at Init,
+// next to the record at key, so that the record remains recoverable
+// should its key be lost. It does nothing if no escrow is configured
+func escrowKey(stub shim.ChaincodeStubInterface, key string, encKey []byte) error {
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+	indexKey, err := recordIndexKey(stub, escrowIndex, key)
+	if err != nil {
+		return err
+	}
+	if cfg.EscrowPublicKey == "" {
+		// drop a wrapped key left by a previous write
+		return stub.DelState(indexKey)
+	}
+
+	wrapped, err := wrapForEscrow(cfg.EscrowPublicKey, encKey)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(indexKey, wrapped)
+}
+
+type decryptFailure struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+type decryptReport struct {
+	Checked int              `json:"checked"`
+	Failed  []decryptFailure `json:"failed"`
+}
+
+// verifyAllDecryptable checks that every encrypted record decrypts under
+// the supplied master key. Records encrypted under a different key, as
+// told by their fingerprint, and records that fail to decrypt are
+// reported; no plaintext is ever returned
+func (t *SimpleAsset) verifyAllDecryptable(stub shim.ChaincodeStubInterface, decKey []byte) (string, error) {
+	ent, err := entities.NewAES256EncrypterEntity("ID", t.bccspInst, decKey, nil)
+	if err != nil {
+		return "", errorf(codeCryptoError, "entities.NewAES256EncrypterEntity failed, err %s", err)
+	}
+	fingerprint, err := t.keyFingerprint(decKey)
+	if err != nil {
+		return "", err
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(encIndex, []string{})
+	if err != nil {
+		return "", err
+	}
+	defer iterator.Close()
+
+	report := decryptReport{Failed: []decryptFailure{}}
+	for iterator.HasNext() {
+		el, err := iterator.Next()
+		if err != nil {
+			return "", err
+		}
+		_, attrs, err := stub.SplitCompositeKey(el.Key)
+		if err != nil {
+			return "", err
+		}
+		key, err := keyFromAttributes(stub, attrs)
+		if err != nil {
+			return "", err
+		}
+
+		report.Checked++
+		if string(el.Value) != fingerprint {
+			report.Failed = append(report.Failed, decryptFailure{key, "encrypted under a different key"})
+			continue
+		}
+		_, err = getStateAndDecrypt(stub, ent, key)
+		if err != nil {
+			report.Failed = append(report.Failed, decryptFailure{key, err.Error()})
+		}
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// listRecordsForRekey returns a json-marshalled list of the keys of
+// encrypted records whose key fingerprint differs from the supplied
+// current one, i.e. the records still encrypted under an older key
+func listRecordsForRekey(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key fingerprint")
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(encIndex, []string{})
+	if err != nil {
+		return "", err
+	}
+	defer iterator.Close()
+
+	stale := []string{}
+	for iterator.HasNext() {
+		el, err := iterator.Next()
+		if err != nil {
+			return "", err
+		}
+		if string(el.Value) == args[0] {
+			continue
+		}
+
+		_, attrs, err := stub.SplitCompositeKey(el.Key)
+		if err != nil {
+			return "", err
+		}
+		key, err := keyFromAttributes(stub, attrs)
+		if err != nil {
+			return "", err
+		}
+		stale = append(stale, key)
+	}
+
+	b, err := json.Marshal(stale)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// requiredKeyFingerprint returns the fingerprint of the key an encrypted
+// record was written with, so that a client can pick the matching key
+// from its keyring before calling decRecord
+func requiredKeyFingerprint(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key")
+	}
+
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	if len(value) == 0 {
+		value = nil
+	}
+	// checked before telling whether the record exists
+	err = checkReader(stub, key, args[0], value)
+	if err != nil {
+		return "", err
+	}
+	if value == nil {
+		return "", errorf(codeNotFound, "Asset not found: %s", args[0])
+	}
+
+	indexKey, err := recordIndexKey(stub, encIndex, key)
+	if err != nil {
+		return "", err
+	}
+	fingerprint, err := stub.GetState(indexKey)
+	if err != nil {
+		return "", err
+	}
+	if fingerprint == nil {
+		return "", errorf(codeBadRequest, "Asset %s is not encrypted", args[0])
+	}
+	return string(fingerprint), nil
+}
+
+// checkIV returns an error unless ciphertext is laid out the way the AES
+// entity writes it: the IV in the first block, followed by at least one
+// block of padded ciphertext
+func checkIV(ciphertext []byte) error {
+	if len(ciphertext) < aes.BlockSize {
+		return errors.New("missing IV")
+	}
+	if len(ciphertext) == aes.BlockSize || len(ciphertext)%aes.BlockSize != 0 {
+		return errors.New("malformed IV or ciphertext")
+	}
+	return nil
+}
+
+// ciphertextSize returns the size of the value the AES entity writes for
+// a cleartext of n bytes: the IV followed by the PKCS#7 padded ciphertext
+func ciphertextSize(n int) int {
+	return aes.BlockSize + (n/aes.BlockSize+1)*aes.BlockSize
+}
+
+// verifyIVIntegrity checks that every encrypted record still carries the
+// IV it needs to be decrypted, and returns the records that do not
+func verifyIVIntegrity(stub shim.ChaincodeStubInterface) (string, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(encIndex, []string{})
+	if err != nil {
+		return "", err
+	}
+	defer iterator.Close()
+
+	report := decryptReport{Failed: []decryptFailure{}}
+	for iterator.HasNext() {
+		el, err := iterator.Next()
+		if err != nil {
+			return "", err
+		}
+		_, attrs, err := stub.SplitCompositeKey(el.Key)
+		if err != nil {
+			return "", err
+		}
+		key, err := keyFromAttributes(stub, attrs)
+		if err != nil {
+			return "", err
+		}
+
+		ciphertext, err := stub.GetState(key)
+		if err != nil {
+			return "", err
+		}
+		report.Checked++
+		err = checkIV(ciphertext)
+		if err != nil {
+			report.Failed = append(report.Failed, decryptFailure{key, err.Error()})
+		}
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
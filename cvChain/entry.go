@@ -0,0 +1,209 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	// entryIndex is the composite key object type the entries of a CV are
+	// stored under, keyed by owner, entry type and sequence
+	entryIndex = "entry"
+	// entrySeqIndex is the composite key object type of the per-owner
+	// counters the sequences of the entries are drawn from
+	entrySeqIndex = "entryseq"
+)
+
+// cvEntry is an entry of a CV as returned by appendEntry and getCV. The
+// issuer of the record is the MSP of the identity that appended it
+type cvEntry struct {
+	Sequence string          `json:"sequence"`
+	Revoked  bool            `json:"revoked"`
+	Record   json.RawMessage `json:"record"`
+}
+
+// curriculumVitae is the document getCV assembles, with the entries of
+// the owner grouped by type in sequence order
+type curriculumVitae struct {
+	Owner   string               `json:"owner"`
+	Entries map[string][]cvEntry `json:"entries"`
+}
+
+// entryKey returns the ledger key of the CV entry of owner identified by
+// entryType and sequence
+func entryKey(stub shim.ChaincodeStubInterface, owner, entryType, sequence string) (string, error) {
+	key, err := stub.CreateCompositeKey(entryIndex, []string{owner, entryType, sequence})
+	if err != nil {
+		return "", errorf(codeBadRequest, "Invalid entry id: %s", err)
+	}
+	return key, nil
+}
+
+// nextEntrySequence increments the entry counter of owner and returns its
+// new value, zero-padded so that entries sort in the order they were
+// appended
+func nextEntrySequence(stub shim.ChaincodeStubInterface, owner string) (string, error) {
+	seqKey, err := stub.CreateCompositeKey(entrySeqIndex, []string{owner})
+	if err != nil {
+		return "", errorf(codeBadRequest, "Invalid entry id: %s", err)
+	}
+	b, err := stub.GetState(seqKey)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get the entry sequence of %s with error: %s", owner, err)
+	}
+	next := uint64(1)
+	if b != nil {
+		current, err := strconv.ParseUint(string(b), 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("Invalid entry sequence of %s: %s", owner, b)
+		}
+		next = current + 1
+	}
+	err = stub.PutState(seqKey, []byte(strconv.FormatUint(next, 10)))
+	if err != nil {
+		return "", fmt.Errorf("Failed to set the entry sequence of %s with error: %s; concurrent appends for the same owner conflict and have to be resubmitted", owner, err)
+	}
+	return fmt.Sprintf("%08d", next), nil
+}
+
+// appendEntry adds the json Record in args[2] to the CV of the owner in
+// args[0] as an entry of the type in args[1], e.g. degree, job or
+// certification, and returns it with its sequence. The issuer of the
+// entry is the MSP of the caller: the document may leave it out, but
+// must otherwise name it. The sequence is drawn from a per-owner counter,
+// so concurrent appends for the same owner conflict: only the first one
+// to be ordered in a block commits, the others fail MVCC validation and
+// must be resubmitted
+func appendEntry(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 3 || args[0] == "" || args[1] == "" {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting an owner, an entry type and an entry")
+	}
+	err := checkPlaintextAllowed(stub)
+	if err != nil {
+		return "", err
+	}
+	mspID, err := callerMSPID(stub)
+	if err != nil {
+		return "", err
+	}
+	r, err := newOwnedRecord(stub, args[0], args[0], args[2], mspID)
+	if err != nil {
+		return "", err
+	}
+	value, err := r.document()
+	if err != nil {
+		return "", err
+	}
+	err = checkIssuer(stub, value)
+	if err != nil {
+		return "", err
+	}
+
+	sequence, err := nextEntrySequence(stub, args[0])
+	if err != nil {
+		return "", err
+	}
+	key, err := entryKey(stub, args[0], args[1], sequence)
+	if err != nil {
+		return "", err
+	}
+	err = checkWriter(stub, key)
+	if err != nil {
+		return "", err
+	}
+	event, err := newRecordEvent(stub, recordAddedEvent, key)
+	if err != nil {
+		return "", err
+	}
+	err = stub.PutState(key, []byte(value))
+	if err != nil {
+		return "", fmt.Errorf("Failed to set entry %s of %s", sequence, args[0])
+	}
+	err = trackModifier(stub, key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to track modifier of entry %s of %s with error: %s", sequence, args[0], err)
+	}
+	err = emitEvent(stub, event)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(cvEntry{Sequence: sequence, Record: json.RawMessage(value)})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// revokeEntry revokes the entry of the owner in args[0] of the type in
+// args[1] and the sequence in args[2] for the reason in args[3], as
+// revokeRecord does records. The entry is kept in the CV, marked revoked
+func revokeEntry(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 4 || args[3] == "" {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting an owner, an entry type, a sequence and a reason")
+	}
+	key, err := entryKey(stub, args[0], args[1], args[2])
+	if err != nil {
+		return "", err
+	}
+	return revokeKey(stub, key, fmt.Sprintf("entry %s %s of %s", args[1], args[2], args[0]), args[3])
+}
+
+// getCV returns the CV of the owner in args[0]: its entries, revoked ones
+// included, grouped by type. Once issuer organizations are configured the
+// entries the caller may not read, those of other issuers unless the
+// caller is the owner, are left out
+func getCV(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 1 || args[0] == "" {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting an owner")
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(entryIndex, []string{args[0]})
+	if err != nil {
+		return "", err
+	}
+	defer iterator.Close()
+
+	cv := curriculumVitae{Owner: args[0], Entries: map[string][]cvEntry{}}
+	for iterator.HasNext() {
+		el, err := iterator.Next()
+		if err != nil {
+			return "", err
+		}
+		_, attrs, err := stub.SplitCompositeKey(el.Key)
+		if err != nil {
+			return "", err
+		}
+		if len(attrs) != 3 {
+			continue
+		}
+		if checkReader(stub, el.Key, args[0], el.Value) != nil {
+			continue
+		}
+		r := Record{}
+		err = json.Unmarshal(el.Value, &r)
+		if err != nil {
+			return "", fmt.Errorf("Invalid entry %s of %s: %s", attrs[2], args[0], err)
+		}
+		cv.Entries[attrs[1]] = append(cv.Entries[attrs[1]], cvEntry{
+			Sequence: attrs[2],
+			Revoked:  r.Revoked,
+			Record:   json.RawMessage(el.Value),
+		})
+	}
+
+	b, err := json.Marshal(cv)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
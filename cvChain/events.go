@@ -0,0 +1,86 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/pkg/errors"
+)
+
+// names of the chaincode events emitted by the write paths
+const (
+	recordAddedEvent   = "RecordAdded"
+	recordUpdatedEvent = "RecordUpdated"
+	recordDeletedEvent = "RecordDeleted"
+	recordRevokedEvent = "RecordRevoked"
+	// the event of a batch is the list of the events of its records
+	recordsWrittenEvent = "RecordsWritten"
+)
+
+// recordEvent is the payload of the event of a record write. Events are
+// visible to whoever can read the block, so the value is left out
+type recordEvent struct {
+	Type      string   `json:"type"`
+	KeyParts  []string `json:"keyParts"`
+	TxID      string   `json:"txId"`
+	Timestamp string   `json:"timestamp"`
+	Encrypted bool     `json:"encrypted,omitempty"`
+}
+
+// newRecordEvent returns the event of type name for the record at key
+func newRecordEvent(stub shim.ChaincodeStubInterface, name, key string) (recordEvent, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return recordEvent{}, errors.WithMessage(err, "could not get transaction timestamp")
+	}
+	return recordEvent{
+		Type:      name,
+		KeyParts:  keyParts(stub, key),
+		TxID:      stub.GetTxID(),
+		Timestamp: formatTimestamp(ts),
+	}, nil
+}
+
+// newWriteEvent returns the event of a write to the record at key, which
+// tells whether the key existed. It has to be called before the write
+func newWriteEvent(stub shim.ChaincodeStubInterface, key string) (recordEvent, error) {
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return recordEvent{}, err
+	}
+	if existing != nil {
+		return newRecordEvent(stub, recordUpdatedEvent, key)
+	}
+	return newRecordEvent(stub, recordAddedEvent, key)
+}
+
+// emitEvent sets the chaincode event of the transaction. A transaction
+// carries a single event, so a later call replaces the event of an
+// earlier one; functions writing several records use emitEvents instead
+func emitEvent(stub shim.ChaincodeStubInterface, event recordEvent) error {
+	return setEvent(stub, event.Type, event)
+}
+
+// emitEvents sets a single chaincode event listing the events of all the
+// records written by the transaction
+func emitEvents(stub shim.ChaincodeStubInterface, events []recordEvent) error {
+	return setEvent(stub, recordsWrittenEvent, events)
+}
+
+func setEvent(stub shim.ChaincodeStubInterface, name string, event interface{}) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal event")
+	}
+	err = stub.SetEvent(name, payload)
+	if err != nil {
+		return errors.WithMessage(err, "could not set event")
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+)
+
+// history is only available on peers with the history database enabled
+// and is not re-validated at commit time, so the functions below are
+// meant for read-only queries
+
+// historyCount returns the number of history entries of key
+func historyCount(stub shim.ChaincodeStubInterface, key string) (int, error) {
+	iterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return 0, err
+	}
+	defer iterator.Close()
+
+	count := 0
+	for iterator.HasNext() {
+		_, err := iterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+type keyCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// rankByCount returns the n keys with the highest counts, highest first;
+// keys with equal counts are ordered by key so the ranking is stable
+func rankByCount(counts map[string]int, n int) []keyCount {
+	ranked := make([]keyCount, 0, len(counts))
+	for key, count := range counts {
+		ranked = append(ranked, keyCount{key, count})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Count != ranked[j].Count {
+			return ranked[i].Count > ranked[j].Count
+		}
+		return ranked[i].Key < ranked[j].Key
+	})
+
+	if len(ranked) > n {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
+
+// hotRecords returns the args[0] records with the most history entries,
+// i.e. the most frequently modified keys, which are the likeliest to
+// cause MVCC read conflicts between concurrent transactions
+func hotRecords(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a number of records")
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 {
+		return "", errorf(codeBadRequest, "Invalid number of records %s", args[0])
+	}
+
+	counts := map[string]int{}
+	err = forEachRecord(stub, func(key string, value []byte) error {
+		count, err := historyCount(stub, key)
+		if err != nil {
+			return fmt.Errorf("Failed to get history of %s: %s", key, err)
+		}
+		counts[key] = count
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(rankByCount(counts, n))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// formatTimestamp returns ts as an RFC 3339 time in UTC
+func formatTimestamp(ts *timestamp.Timestamp) string {
+	if ts == nil {
+		return ""
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC().Format(time.RFC3339Nano)
+}
+
+// creationTimestamp returns the time of the transaction that created the
+// record at key, i.e. the first write of its history after the last
+// deletion, or an empty string if its history holds no write
+func creationTimestamp(stub shim.ChaincodeStubInterface, key string) (string, error) {
+	iterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return "", err
+	}
+	defer iterator.Close()
+
+	created := ""
+	for iterator.HasNext() {
+		mod, err := iterator.Next()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case mod.IsDelete:
+			created = ""
+		case created == "":
+			created = formatTimestamp(mod.Timestamp)
+		}
+	}
+	return created, nil
+}
+
+// lastWriteTxID returns the ID of the transaction that last wrote the
+// record at key, or an empty string if its history holds no write
+func lastWriteTxID(stub shim.ChaincodeStubInterface, key string) (string, error) {
+	iterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return "", err
+	}
+	defer iterator.Close()
+
+	txID := ""
+	for iterator.HasNext() {
+		mod, err := iterator.Next()
+		if err != nil {
+			return "", err
+		}
+		if !mod.IsDelete {
+			txID = mod.TxId
+		}
+	}
+	return txID, nil
+}
+
+// checkHistoryReader returns an error unless the caller may read the
+// record at key as it is now, which decides who may read its history: a
+// deleted record's history is left to its owner
+func checkHistoryReader(stub shim.ChaincodeStubInterface, key string) error {
+	value, err := stub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to get asset: %s with error: %s", key, err)
+	}
+	if len(value) == 0 {
+		value = nil
+	}
+	owner, _ := splitKey(stub, key)
+	return checkReader(stub, key, owner, value)
+}
+
+type historyEntry struct {
+	TxID      string `json:"txId"`
+	Timestamp string `json:"timestamp"`
+	Value     string `json:"value"`
+	IsDelete  bool   `json:"isDelete"`
+}
+
+// getHistory returns a json-marshalled list of every version of the
+// specified asset key, oldest first, as stored: encrypted values are
+// returned encrypted
+func getHistory(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key")
+	}
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	err = checkHistoryReader(stub, key)
+	if err != nil {
+		return "", err
+	}
+
+	iterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get history of asset: %s with error: %s", args[0], err)
+	}
+	defer iterator.Close()
+
+	history := []historyEntry{}
+	for iterator.HasNext() {
+		mod, err := iterator.Next()
+		if err != nil {
+			return "", fmt.Errorf("Failed to get history of asset: %s with error: %s", args[0], err)
+		}
+		history = append(history, historyEntry{
+			TxID:      mod.TxId,
+			Timestamp: formatTimestamp(mod.Timestamp),
+			Value:     string(mod.Value),
+			IsDelete:  mod.IsDelete,
+		})
+	}
+
+	b, err := json.Marshal(history)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+type recordVersion struct {
+	TxID      string `json:"txId"`
+	Timestamp string `json:"timestamp"`
+	// Value is the record document or, if Encrypted, the base64 encoded
+	// ciphertext
+	Value     string `json:"value"`
+	IsDelete  bool   `json:"isDelete"`
+	Encrypted bool   `json:"encrypted"`
+}
+
+// getRecordHistory returns a json-marshalled list of the versions of the
+// specified asset key, oldest first, so that a verifier can tell whether
+// a record changed after it was issued. At most args[2] versions (or
+// maxPageSize if no limit is given) are returned. Versions that are not
+// json documents but are laid out like ciphertext are returned base64
+// encoded and flagged as encrypted
+func getRecordHistory(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key and optionally a limit")
+	}
+	limit := maxPageSize
+	if len(args) == 3 {
+		var err error
+		limit, err = parsePageSize(args[2])
+		if err != nil {
+			return "", err
+		}
+	}
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	err = checkHistoryReader(stub, key)
+	if err != nil {
+		return "", err
+	}
+
+	iterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get history of asset: %s with error: %s", args[0], err)
+	}
+	defer iterator.Close()
+
+	history := []recordVersion{}
+	for len(history) < limit && iterator.HasNext() {
+		mod, err := iterator.Next()
+		if err != nil {
+			return "", fmt.Errorf("Failed to get history of asset: %s with error: %s", args[0], err)
+		}
+		version := recordVersion{
+			TxID:      mod.TxId,
+			Timestamp: formatTimestamp(mod.Timestamp),
+			Value:     string(mod.Value),
+			IsDelete:  mod.IsDelete,
+		}
+		if !mod.IsDelete && !json.Valid(mod.Value) && checkIV(mod.Value) == nil {
+			version.Value = base64.StdEncoding.EncodeToString(mod.Value)
+			version.Encrypted = true
+		}
+		history = append(history, version)
+	}
+
+	b, err := json.Marshal(history)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// selectVersion returns the entry of history, ordered oldest first, that
+// was current as of point: either the entry written by the transaction
+// with that ID or, if point is an RFC 3339 time, the last entry written
+// at or before it. It returns nil if there is no such entry
+func selectVersion(history []*queryresult.KeyModification, point string) *queryresult.KeyModification {
+	at, err := time.Parse(time.RFC3339Nano, point)
+	if err != nil {
+		for _, mod := range history {
+			if mod.TxId == point {
+				return mod
+			}
+		}
+		return nil
+	}
+
+	var current *queryresult.KeyModification
+	for _, mod := range history {
+		if mod.Timestamp == nil {
+			continue
+		}
+		if time.Unix(mod.Timestamp.Seconds, int64(mod.Timestamp.Nanos)).After(at) {
+			break
+		}
+		current = mod
+	}
+	return current
+}
+
+// getRecordAsOf returns the value the specified asset key had as of the
+// transaction ID or RFC 3339 time in args[2]
+func getRecordAsOf(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 3 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key and a transaction ID or time")
+	}
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	err = checkHistoryReader(stub, key)
+	if err != nil {
+		return "", err
+	}
+
+	iterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get history of asset: %s with error: %s", args[0], err)
+	}
+	defer iterator.Close()
+
+	history := []*queryresult.KeyModification{}
+	for iterator.HasNext() {
+		mod, err := iterator.Next()
+		if err != nil {
+			return "", fmt.Errorf("Failed to get history of asset: %s with error: %s", args[0], err)
+		}
+		history = append(history, mod)
+	}
+
+	mod := selectVersion(history, args[2])
+	if mod == nil || mod.IsDelete {
+		return "", errorf(codeNotFound, "Asset not found: %s as of %s", args[0], args[2])
+	}
+	return string(mod.Value), nil
+}
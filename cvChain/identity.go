@@ -0,0 +1,345 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	"github.com/pkg/errors"
+)
+
+const (
+	// modifierIndex is the composite key object type under which the MSP
+	// ID of the last identity to write each record is kept
+	modifierIndex = "modifier"
+	// modifiedByIndex is the composite key object type of the index from
+	// an MSP ID to the records it was the last to write
+	modifiedByIndex = "modifiedBy"
+	// creatorIndex is the composite key object type under which the ID of
+	// the identity that created each record is kept
+	creatorIndex = "creator"
+	// overrideAttr is the certificate attribute that, set to "true" on a
+	// member of the admin MSP, allows writing records created by others
+	overrideAttr = "cvchain.override"
+)
+
+// attrOID is the OID of the x509 extension the Fabric CA stores the
+// attributes of an identity in, as a JSON object under "attrs"
+var attrOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+// callerMSPID returns the MSP ID of the identity that submitted the
+// transaction, as found in the serialized creator of the proposal
+func callerMSPID(stub shim.ChaincodeStubInterface) (string, error) {
+	creator, err := stub.GetCreator()
+	if err != nil {
+		return "", errors.WithMessage(err, "could not retrieve creator")
+	}
+
+	sid := &msp.SerializedIdentity{}
+	err = proto.Unmarshal(creator, sid)
+	if err != nil {
+		return "", errors.Wrap(err, "could not unmarshal creator")
+	}
+	if sid.Mspid == "" {
+		return "", errors.New("creator has no MSP ID")
+	}
+	return sid.Mspid, nil
+}
+
+// callerCert returns the x509 certificate of the identity that submitted
+// the transaction
+func callerCert(stub shim.ChaincodeStubInterface) (*x509.Certificate, error) {
+	creator, err := stub.GetCreator()
+	if err != nil {
+		return nil, errors.WithMessage(err, "could not retrieve creator")
+	}
+
+	sid := &msp.SerializedIdentity{}
+	err = proto.Unmarshal(creator, sid)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal creator")
+	}
+	bl, _ := pem.Decode(sid.IdBytes)
+	if bl == nil {
+		return nil, errors.New("creator has no PEM encoded certificate")
+	}
+	cert, err := x509.ParseCertificate(bl.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse creator certificate")
+	}
+	return cert, nil
+}
+
+// callerID returns an ID unique to the identity that submitted the
+// transaction within its MSP, built from the subject and issuer of its
+// certificate the way the cid library does, which this shim predates
+func callerID(stub shim.ChaincodeStubInterface) (string, error) {
+	cert, err := callerCert(stub)
+	if err != nil {
+		return "", err
+	}
+	id := fmt.Sprintf("x509::%s::%s", cert.Subject.String(), cert.Issuer.String())
+	return base64.StdEncoding.EncodeToString([]byte(id)), nil
+}
+
+// callerAttribute returns the value of the named attribute of the
+// identity that submitted the transaction, and whether it is set
+func callerAttribute(stub shim.ChaincodeStubInterface, name string) (string, bool, error) {
+	cert, err := callerCert(stub)
+	if err != nil {
+		return "", false, err
+	}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(attrOID) {
+			continue
+		}
+		attrs := struct {
+			Attrs map[string]string `json:"attrs"`
+		}{}
+		err = json.Unmarshal(ext.Value, &attrs)
+		if err != nil {
+			return "", false, errors.Wrap(err, "could not unmarshal attributes")
+		}
+		value, in := attrs.Attrs[name]
+		return value, in, nil
+	}
+	return "", false, nil
+}
+
+// requireAdmin returns an error unless the caller belongs to the admin
+// MSP configured at Init; without one, no caller is an admin
+func requireAdmin(stub shim.ChaincodeStubInterface, cfg *chaincodeConfig) error {
+	if cfg.AdminMSP == "" {
+		return errorf(codeForbidden, "no admin MSP is configured")
+	}
+
+	mspID, err := callerMSPID(stub)
+	if err != nil {
+		return err
+	}
+	if mspID != cfg.AdminMSP {
+		return errorf(codeForbidden, "caller MSP %s is not the admin MSP", mspID)
+	}
+	return nil
+}
+
+// checkWriter returns an error unless the caller may write the record at
+// key, i.e. it is the identity that created the record or, to break the
+// glass, a member of the admin MSP with the override attribute. A record
+// not created yet, or created before creators were tracked, is claimed by
+// the caller
+func checkWriter(stub shim.ChaincodeStubInterface, key string) error {
+	id, err := callerID(stub)
+	if err != nil {
+		return err
+	}
+	creatorKey, err := recordIndexKey(stub, creatorIndex, key)
+	if err != nil {
+		return err
+	}
+	creator, err := stub.GetState(creatorKey)
+	if err != nil {
+		return err
+	}
+	if creator == nil {
+		return stub.PutState(creatorKey, []byte(id))
+	}
+	if string(creator) == id {
+		return nil
+	}
+
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+	if requireAdmin(stub, cfg) == nil {
+		override, _, err := callerAttribute(stub, overrideAttr)
+		if err != nil {
+			return err
+		}
+		if override == "true" {
+			return nil
+		}
+	}
+	return errorf(codeForbidden, "permission denied: %s was created by another identity", key)
+}
+
+// modifiedByKey returns the key of the modifiedBy index entry listing the
+// record at key under mspID
+func modifiedByKey(stub shim.ChaincodeStubInterface, mspID, key string) (string, error) {
+	attrs, err := keyAttributes(stub, key)
+	if err != nil {
+		return "", err
+	}
+	return stub.CreateCompositeKey(modifiedByIndex, append([]string{mspID}, attrs...))
+}
+
+// trackModifier records the caller as the last identity to write the
+// record at key, moving the record out of the modifiedBy index of the
+// previous modifier
+func trackModifier(stub shim.ChaincodeStubInterface, key string) error {
+	mspID, err := callerMSPID(stub)
+	if err != nil {
+		return err
+	}
+
+	modifierKey, err := recordIndexKey(stub, modifierIndex, key)
+	if err != nil {
+		return err
+	}
+	previous, err := stub.GetState(modifierKey)
+	if err != nil {
+		return err
+	}
+	if previous != nil {
+		indexKey, err := modifiedByKey(stub, string(previous), key)
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(indexKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = stub.PutState(modifierKey, []byte(mspID))
+	if err != nil {
+		return err
+	}
+	indexKey, err := modifiedByKey(stub, mspID, key)
+	if err != nil {
+		return err
+	}
+	// the value does not matter, but an empty one would delete the key
+	return stub.PutState(indexKey, []byte{0})
+}
+
+// clearIdentities drops the creator and the last modifier of the record
+// at key
+func clearIdentities(stub shim.ChaincodeStubInterface, key string) error {
+	creatorKey, err := recordIndexKey(stub, creatorIndex, key)
+	if err != nil {
+		return err
+	}
+	err = stub.DelState(creatorKey)
+	if err != nil {
+		return err
+	}
+
+	modifierKey, err := recordIndexKey(stub, modifierIndex, key)
+	if err != nil {
+		return err
+	}
+	previous, err := stub.GetState(modifierKey)
+	if err != nil {
+		return err
+	}
+	if previous == nil {
+		return nil
+	}
+	indexKey, err := modifiedByKey(stub, string(previous), key)
+	if err != nil {
+		return err
+	}
+	err = stub.DelState(indexKey)
+	if err != nil {
+		return err
+	}
+	return stub.DelState(modifierKey)
+}
+
+// moveIdentities moves the creator and the last modifier of the record at
+// from over to the record at to
+func moveIdentities(stub shim.ChaincodeStubInterface, from, to string) error {
+	ids := map[string][]byte{}
+	for _, index := range []string{creatorIndex, modifierIndex} {
+		indexKey, err := recordIndexKey(stub, index, from)
+		if err != nil {
+			return err
+		}
+		ids[index], err = stub.GetState(indexKey)
+		if err != nil {
+			return err
+		}
+	}
+	err := clearIdentities(stub, from)
+	if err != nil {
+		return err
+	}
+
+	if ids[creatorIndex] != nil {
+		creatorKey, err := recordIndexKey(stub, creatorIndex, to)
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(creatorKey, ids[creatorIndex])
+		if err != nil {
+			return err
+		}
+	}
+	if ids[modifierIndex] == nil {
+		return nil
+	}
+	modifierKey, err := recordIndexKey(stub, modifierIndex, to)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(modifierKey, ids[modifierIndex])
+	if err != nil {
+		return err
+	}
+	indexKey, err := modifiedByKey(stub, string(ids[modifierIndex]), to)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(indexKey, []byte{0})
+}
+
+// getRecordsModifiedBy returns a json-marshalled list of the keys of the
+// records last written by a member of the MSP in args[0]
+func getRecordsModifiedBy(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting an MSP ID")
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(modifiedByIndex, []string{args[0]})
+	if err != nil {
+		return "", err
+	}
+	defer iterator.Close()
+
+	keys := []string{}
+	for iterator.HasNext() {
+		el, err := iterator.Next()
+		if err != nil {
+			return "", err
+		}
+		_, attrs, err := stub.SplitCompositeKey(el.Key)
+		if err != nil {
+			return "", err
+		}
+		key, err := keyFromAttributes(stub, attrs[1:])
+		if err != nil {
+			return "", err
+		}
+		keys = append(keys, key)
+	}
+
+	b, err := json.Marshal(keys)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
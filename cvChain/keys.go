@@ -0,0 +1,535 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/pkg/errors"
+)
+
+const (
+	// recordIndex is the composite key object type records are stored
+	// under, keyed by their two ids
+	recordIndex = "record"
+	// encRecordIndex is the composite key object type encrypted records
+	// are stored under, keyed by their two ids like plaintext ones, so
+	// that a range of either namespace holds a single kind of value
+	encRecordIndex = "encrecord"
+	// foldIndex is the composite key object type of the index that maps
+	// the lowercased ids of a record to the key the record was written
+	// with
+	foldIndex = "fold"
+)
+
+// recordIndexes lists the object types records are stored under, in key
+// order
+var recordIndexes = []string{encRecordIndex, recordIndex}
+
+// recordKey builds the ledger key of the record identified by id1 and id2
+func recordKey(stub shim.ChaincodeStubInterface, id1, id2 string) (string, error) {
+	key, err := stub.CreateCompositeKey(recordIndex, []string{id1, id2})
+	if err != nil {
+		return "", errors.WithMessage(err, "invalid record id")
+	}
+	return key, nil
+}
+
+// encRecordKey builds the ledger key of the encrypted record identified
+// by id1 and id2
+func encRecordKey(stub shim.ChaincodeStubInterface, id1, id2 string) (string, error) {
+	key, err := stub.CreateCompositeKey(encRecordIndex, []string{id1, id2})
+	if err != nil {
+		return "", errors.WithMessage(err, "invalid record id")
+	}
+	return key, nil
+}
+
+// storedKey returns the composite key the record identified by id1 and
+// id2 is stored under: its encrypted key if an encrypted record is
+// stored there, its plaintext key otherwise. Both carry the same
+// attributes, so the index entries about a record hold for either
+func storedKey(stub shim.ChaincodeStubInterface, id1, id2 string) (string, error) {
+	key, err := encRecordKey(stub, id1, id2)
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", errors.WithMessage(err, "could not read record")
+	}
+	if value != nil {
+		return key, nil
+	}
+	return recordKey(stub, id1, id2)
+}
+
+// namespaceKey returns the key the record resolved to key is written
+// under, in the namespace of encrypted records if encrypted is set and
+// in that of plaintext records otherwise. A record stored in the other
+// namespace is dropped from there, the caller overwriting its value,
+// and the fold index entry is pointed at the new key; its history stays
+// with the former key. A record stored under its legacy key keeps being
+// written there
+func namespaceKey(stub shim.ChaincodeStubInterface, key string, encrypted bool) (string, error) {
+	if !strings.HasPrefix(key, "\x00") {
+		return key, nil
+	}
+	id1, id2 := splitKey(stub, key)
+	namespacedKey := recordKey
+	if encrypted {
+		namespacedKey = encRecordKey
+	}
+	newKey, err := namespacedKey(stub, id1, id2)
+	if err != nil || newKey == key {
+		return newKey, err
+	}
+
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", errors.WithMessage(err, "could not read record")
+	}
+	if value != nil {
+		err = stub.DelState(key)
+		if err != nil {
+			return "", errors.WithMessage(err, "could not move record")
+		}
+	}
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return "", err
+	}
+	if cfg.CaseInsensitiveIDs {
+		fk, err := foldKey(stub, newKey)
+		if err != nil {
+			return "", err
+		}
+		err = stub.PutState(fk, []byte(newKey))
+		if err != nil {
+			return "", errors.WithMessage(err, "could not write fold index")
+		}
+	}
+	return newKey, nil
+}
+
+// legacyKey builds the key the record identified by id1 and id2 was
+// stored under before records were keyed by composite keys. Since the ids
+// are joined with a plain separator, an id1 containing one cannot be told
+// apart from an id2 containing one
+func legacyKey(id1, id2 string) string {
+	return id1 + ":" + id2
+}
+
+// keyAttributes returns the attributes identifying the record at key in
+// the composite keys of the indexes kept about it: its two ids or, for a
+// record stored under a legacy key, the whole key. A composite key cannot
+// be an attribute of another one, hence the distinction
+func keyAttributes(stub shim.ChaincodeStubInterface, key string) ([]string, error) {
+	if !strings.HasPrefix(key, "\x00") {
+		return []string{key}, nil
+	}
+	_, attrs, err := stub.SplitCompositeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+// keyFromAttributes returns the key of the record identified by attributes
+// returned by keyAttributes
+func keyFromAttributes(stub shim.ChaincodeStubInterface, attrs []string) (string, error) {
+	switch len(attrs) {
+	case 1:
+		return attrs[0], nil
+	case 2:
+		return storedKey(stub, attrs[0], attrs[1])
+	case 3:
+		return stub.CreateCompositeKey(entryIndex, attrs)
+	}
+	return "", errorf(codeBadRequest, "invalid record attributes %v", attrs)
+}
+
+// recordIndexKey returns the key of the entry of index about the record at key,
+// followed by the extra attributes if any
+func recordIndexKey(stub shim.ChaincodeStubInterface, index, key string, extra ...string) (string, error) {
+	attrs, err := keyAttributes(stub, key)
+	if err != nil {
+		return "", err
+	}
+	return stub.CreateCompositeKey(index, append(attrs, extra...))
+}
+
+// foldKey returns the key of the fold index entry of the record at key
+func foldKey(stub shim.ChaincodeStubInterface, key string) (string, error) {
+	attrs, err := keyAttributes(stub, key)
+	if err != nil {
+		return "", err
+	}
+	for i := range attrs {
+		attrs[i] = strings.ToLower(attrs[i])
+	}
+	k, err := stub.CreateCompositeKey(foldIndex, attrs)
+	if err != nil {
+		return "", errors.WithMessage(err, "could not create fold index key")
+	}
+	return k, nil
+}
+
+// resolveKey returns the ledger key of the record identified by id1 and
+// id2. When case-insensitive ids are enabled, the lowercased ids are
+// looked up in the fold index so that ids differing only in case resolve
+// to the record that was written first, whose key keeps its original
+// case. An encrypted record is found under its encrypted key, and one
+// stored under its legacy key by an earlier version of the chaincode
+// keeps being read and written there; a missing record resolves to its
+// plaintext key. If create is set and no record is indexed yet, the fold
+// index entry is written
+func resolveKey(stub shim.ChaincodeStubInterface, id1, id2 string, create bool) (string, error) {
+	key, err := storedKey(stub, id1, id2)
+	if err != nil {
+		return "", err
+	}
+	legacy := legacyKey(id1, id2)
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return "", err
+	}
+
+	if cfg.CaseInsensitiveIDs {
+		for _, k := range []string{key, legacy} {
+			fk, err := foldKey(stub, k)
+			if err != nil {
+				return "", err
+			}
+			original, err := stub.GetState(fk)
+			if err != nil {
+				return "", errors.WithMessage(err, "could not read fold index")
+			}
+			if original != nil {
+				return string(original), nil
+			}
+		}
+	}
+
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", errors.WithMessage(err, "could not read record")
+	}
+	if value == nil {
+		value, err = stub.GetState(legacy)
+		if err != nil {
+			return "", errors.WithMessage(err, "could not read record")
+		}
+		if value != nil {
+			return legacy, nil
+		}
+	}
+
+	if create && cfg.CaseInsensitiveIDs {
+		fk, err := foldKey(stub, key)
+		if err != nil {
+			return "", err
+		}
+		err = stub.PutState(fk, []byte(key))
+		if err != nil {
+			return "", errors.WithMessage(err, "could not write fold index")
+		}
+	}
+	return key, nil
+}
+
+// clearFoldKey drops the fold index entry of the record at key, if
+// case-insensitive ids are enabled
+func clearFoldKey(stub shim.ChaincodeStubInterface, key string) error {
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+	if !cfg.CaseInsensitiveIDs {
+		return nil
+	}
+	fk, err := foldKey(stub, key)
+	if err != nil {
+		return err
+	}
+	return stub.DelState(fk)
+}
+
+// indexEntry is an entry of an index about a record that is keyed by an
+// extra attribute, such as a snapshot id
+type indexEntry struct {
+	key   string
+	extra string
+	value []byte
+}
+
+// recordIndexEntries returns the entries of index about the record at key
+// in key order
+func recordIndexEntries(stub shim.ChaincodeStubInterface, index, key string) ([]indexEntry, error) {
+	attrs, err := keyAttributes(stub, key)
+	if err != nil {
+		return nil, err
+	}
+	iterator, err := stub.GetStateByPartialCompositeKey(index, attrs)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	entries := []indexEntry{}
+	for iterator.HasNext() {
+		el, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		// the entries of a record whose first id is the legacy key of
+		// this one share its prefix
+		_, entryAttrs, err := stub.SplitCompositeKey(el.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(entryAttrs) != len(attrs)+1 {
+			continue
+		}
+		entries = append(entries, indexEntry{el.Key, entryAttrs[len(attrs)], el.Value})
+	}
+	return entries, nil
+}
+
+// deleteIndexEntries drops all the entries of index about the record at
+// key
+func deleteIndexEntries(stub shim.ChaincodeStubInterface, index, key string) error {
+	entries, err := recordIndexEntries(stub, index, key)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = stub.DelState(entry.key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveIndexEntries moves the entries of index about the record at from
+// over to the record at to
+func moveIndexEntries(stub shim.ChaincodeStubInterface, index, from, to string) error {
+	entries, err := recordIndexEntries(stub, index, from)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = stub.DelState(entry.key)
+		if err != nil {
+			return err
+		}
+		indexKey, err := recordIndexKey(stub, index, to, entry.extra)
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(indexKey, entry.value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveFoldKey points the fold index entry of the record at from to the
+// record at to, if case-insensitive ids are enabled. The entry of to is
+// kept if another record claimed it first
+func moveFoldKey(stub shim.ChaincodeStubInterface, from, to string) error {
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+	if !cfg.CaseInsensitiveIDs {
+		return nil
+	}
+	err = clearFoldKey(stub, from)
+	if err != nil {
+		return err
+	}
+	fk, err := foldKey(stub, to)
+	if err != nil {
+		return err
+	}
+	original, err := stub.GetState(fk)
+	if err != nil || original != nil {
+		return err
+	}
+	return stub.PutState(fk, []byte(to))
+}
+
+// splitKey returns the two ids a record key was built from. For a legacy
+// key, whose ids are joined with a plain separator, the first separator
+// is assumed
+func splitKey(stub shim.ChaincodeStubInterface, key string) (string, string) {
+	if strings.HasPrefix(key, "\x00") {
+		_, attrs, err := stub.SplitCompositeKey(key)
+		if err == nil && len(attrs) == 2 {
+			return attrs[0], attrs[1]
+		}
+	}
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// keyParts returns the ids identifying the record at key to clients: the
+// two ids of a record, or the owner, type and sequence of a CV entry
+func keyParts(stub shim.ChaincodeStubInterface, key string) []string {
+	if strings.HasPrefix(key, "\x00") {
+		objectType, attrs, err := stub.SplitCompositeKey(key)
+		if err == nil && objectType == entryIndex {
+			return attrs
+		}
+	}
+	owner, id := splitKey(stub, key)
+	return []string{owner, id}
+}
+
+// errStopIteration can be returned by the function passed to the record
+// iterators below to stop iterating early without failing
+var errStopIteration = errors.New("stop iteration")
+
+// forEachCompositeRecord calls fn with the key and value of every record
+// stored under objectType whose composite key starts with attrs, in key
+// order, until fn returns an error, which is returned as is
+func forEachCompositeRecord(stub shim.ChaincodeStubInterface, objectType string, attrs []string, fn func(key string, value []byte) error) error {
+	iterator, err := stub.GetStateByPartialCompositeKey(objectType, attrs)
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		el, err := iterator.Next()
+		if err != nil {
+			return err
+		}
+		err = fn(el.Key, el.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachRecordInNamespace calls fn with the key and value of every
+// record stored under objectType whose key falls between start
+// (inclusive) and end (exclusive, or open-ended if empty), in key order.
+// Composite keys cannot be range queried, so the records sorting before
+// start are read and skipped: the cost of a range grows with its
+// position. errStopIteration is returned once fn returns it or end is
+// reached
+func forEachRecordInNamespace(stub shim.ChaincodeStubInterface, objectType, start, end string, fn func(key string, value []byte) error) error {
+	return forEachCompositeRecord(stub, objectType, []string{}, func(key string, value []byte) error {
+		if key < start {
+			return nil
+		}
+		if end != "" && key >= end {
+			return errStopIteration
+		}
+		return fn(key, value)
+	})
+}
+
+// forEachRecordInRange calls fn with the key and value of every record
+// whose ledger key falls between start (inclusive) and end (exclusive, or
+// open-ended if empty), in key order, which puts the encrypted records
+// first, then the plaintext ones and last those stored under legacy keys
+func forEachRecordInRange(stub shim.ChaincodeStubInterface, start, end string, fn func(key string, value []byte) error) error {
+	if start == "" || strings.HasPrefix(start, "\x00") {
+		for _, objectType := range recordIndexes {
+			err := forEachRecordInNamespace(stub, objectType, start, end, fn)
+			if err == errStopIteration {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		start = ""
+	}
+	if strings.HasPrefix(end, "\x00") {
+		return nil
+	}
+	if end == "" {
+		end = maxKey
+	}
+
+	iterator, err := stub.GetStateByRange(start, end)
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		el, err := iterator.Next()
+		if err != nil {
+			return err
+		}
+		if !isLegacyRecordKey(el.Key) {
+			continue
+		}
+		err = fn(el.Key, el.Value)
+		if err == errStopIteration {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachOwnerRecord calls fn with the key and value of every record
+// whose first id is owner, in key order, including those stored under
+// legacy keys, which all sort between owner+":" and owner+";"
+func forEachOwnerRecord(stub shim.ChaincodeStubInterface, owner string, fn func(key string, value []byte) error) error {
+	for _, objectType := range recordIndexes {
+		err := forEachCompositeRecord(stub, objectType, []string{owner}, fn)
+		if err == errStopIteration {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	legacy, err := stub.GetStateByRange(owner+":", owner+";")
+	if err != nil {
+		return err
+	}
+	defer legacy.Close()
+
+	for legacy.HasNext() {
+		el, err := legacy.Next()
+		if err != nil {
+			return err
+		}
+		err = fn(el.Key, el.Value)
+		if err == errStopIteration {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isLegacyRecordKey reports whether key holds a record stored under a
+// legacy key, as opposed to the reserved keys or a composite key
+func isLegacyRecordKey(key string) bool {
+	return key != configKey && key != instantiatedKey && !strings.HasPrefix(key, "\x00")
+}
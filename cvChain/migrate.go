@@ -0,0 +1,218 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/pkg/errors"
+)
+
+// migrateArg is the second argument of Init that moves the records stored
+// under legacy keys to composite keys
+const migrateArg = "migrate"
+
+// initReport is the result of Init
+type initReport struct {
+	// Upgrade tells whether a previous version had been instantiated or
+	// had stored a configuration or records
+	Upgrade bool `json:"upgrade"`
+	// LegacyRecords counts the records stored under legacy keys before
+	// the migration, if any
+	LegacyRecords int              `json:"legacyRecords"`
+	Migrated      int              `json:"migrated"`
+	Skipped       []decryptFailure `json:"skipped"`
+}
+
+// initChaincode applies the arguments of Init: an optional json
+// configuration in args[0], whose settings override those stored by an
+// earlier Init while the others are kept, and an optional migrateArg in
+// args[1] moving the records stored under legacy keys to composite keys.
+// An empty configuration keeps the stored one as is
+func initChaincode(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) > 2 || len(args) == 2 && args[1] != migrateArg {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a configuration and optionally %s", migrateArg)
+	}
+
+	report := initReport{Skipped: []decryptFailure{}}
+	for _, key := range []string{configKey, instantiatedKey} {
+		b, err := stub.GetState(key)
+		if err != nil {
+			return "", fmt.Errorf("Could not read %s, err %s", key, err)
+		}
+		report.Upgrade = report.Upgrade || b != nil
+	}
+	err := putInstantiatedAt(stub)
+	if err != nil {
+		return "", fmt.Errorf("Could not store instantiation time, err %s", err)
+	}
+
+	if len(args) > 0 && args[0] != "" {
+		cfg, err := getConfig(stub)
+		if err != nil {
+			return "", err
+		}
+		// settings left out of the configuration keep their stored value
+		err = json.Unmarshal([]byte(args[0]), cfg)
+		if err != nil {
+			return "", errorf(codeBadRequest, "Could not parse configuration, err %s", err)
+		}
+		err = cfg.validate()
+		if err != nil {
+			return "", err
+		}
+		err = putConfig(stub, cfg)
+		if err != nil {
+			return "", fmt.Errorf("Could not store configuration, err %s", err)
+		}
+	}
+
+	keys, err := legacyRecordKeys(stub)
+	if err != nil {
+		return "", err
+	}
+	report.LegacyRecords = len(keys)
+	report.Upgrade = report.Upgrade || len(keys) > 0
+	if len(args) == 2 {
+		for _, key := range keys {
+			err = migrateLegacyRecord(stub, key)
+			if err != nil {
+				report.Skipped = append(report.Skipped, decryptFailure{key, err.Error()})
+				continue
+			}
+			report.Migrated++
+		}
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// legacyRecordKeys returns the keys of the records stored under legacy
+// keys, in key order
+func legacyRecordKeys(stub shim.ChaincodeStubInterface) ([]string, error) {
+	iterator, err := stub.GetStateByRange("", maxKey)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	keys := []string{}
+	for iterator.HasNext() {
+		el, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if isLegacyRecordKey(el.Key) {
+			keys = append(keys, el.Key)
+		}
+	}
+	return keys, nil
+}
+
+// migrateLegacyRecord moves the record stored under the legacy key to the
+// composite key of its ids, along with its metadata, identities,
+// snapshots, grants and fold index entry. Its history stays with the
+// legacy key. An encrypted record is moved as is, among the encrypted
+// records; a plaintext one must be a json Record or a value in the
+// colon-delimited format of earlier versions, which is converted to one.
+// The first separator of the key is taken to split the ids, as splitKey
+// does
+func migrateLegacyRecord(stub shim.ChaincodeStubInterface, key string) error {
+	value, err := stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	id1, id2 := splitKey(stub, key)
+	newKey, err := storedKey(stub, id1, id2)
+	if err != nil {
+		return err
+	}
+	existing, err := stub.GetState(newKey)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return errorf(codeConflict, "Asset already exists: %s", newKey)
+	}
+	encrypted, err := isEncrypted(stub, key)
+	if err != nil {
+		return err
+	}
+	if encrypted {
+		newKey, err = encRecordKey(stub, id1, id2)
+	} else {
+		_, err = parseRecord(value)
+		if err != nil && !json.Valid(value) {
+			value, err = convertLegacyValue(stub, id1, value)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(newKey, value)
+	if err != nil {
+		return err
+	}
+	err = stub.DelState(key)
+	if err != nil {
+		return err
+	}
+	err = copyRecordMeta(stub, key, newKey)
+	if err != nil {
+		return errors.WithMessage(err, "copyRecordMeta failed")
+	}
+	err = clearRecordMeta(stub, key)
+	if err != nil {
+		return errors.WithMessage(err, "clearRecordMeta failed")
+	}
+	err = moveIdentities(stub, key, newKey)
+	if err != nil {
+		return errors.WithMessage(err, "moveIdentities failed")
+	}
+	for _, index := range []string{snapIndex, grantIndex} {
+		err = moveIndexEntries(stub, index, key, newKey)
+		if err != nil {
+			return errors.WithMessage(err, "moveIndexEntries failed")
+		}
+	}
+	return moveFoldKey(stub, key, newKey)
+}
+
+// convertLegacyValue returns the json Record of the value of owner in the
+// colon-delimited format of earlier versions, a title and an issuer. The
+// value predates versions and timestamps: the record is converted as its
+// first version, updated by the migration
+func convertLegacyValue(stub shim.ChaincodeStubInterface, owner string, value []byte) ([]byte, error) {
+	parts := strings.SplitN(string(value), ":", 2)
+	if len(parts) != 2 {
+		return nil, errorf(codeBadRequest, "invalid record: neither a json document nor a colon-delimited value")
+	}
+	r := Record{Owner: owner, Title: parts[0], Issuer: parts[1]}
+	err := r.validate()
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid colon-delimited record")
+	}
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, errors.WithMessage(err, "could not get transaction timestamp")
+	}
+	r.Version = 1
+	r.UpdatedAt = formatTimestamp(ts)
+	doc, err := r.document()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(doc), nil
+}
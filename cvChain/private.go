@@ -0,0 +1,203 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/bccsp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/pkg/errors"
+)
+
+// privateHashIndex is the composite key object type under which the
+// hex encoded SHA-256 of a record kept in a private data collection is
+// stored on the channel ledger, keyed by the record key and collection
+const privateHashIndex = "privhash"
+
+// privateDataStub is the part of the stub giving access to private data
+// collections. The vendored shim only declares it in the stub interface,
+// and only implements it, when built with the experimental tag
+type privateDataStub interface {
+	GetPrivateData(collection, key string) ([]byte, error)
+	PutPrivateData(collection, key string, value []byte) error
+}
+
+// getPrivateDataStub returns the private data interface of stub, or an
+// error if the chaincode was built without support for it
+func getPrivateDataStub(stub shim.ChaincodeStubInterface) (privateDataStub, error) {
+	pstub, ok := stub.(privateDataStub)
+	if !ok {
+		return nil, errors.New("private data collections are not supported, the chaincode has to be built with the experimental tag")
+	}
+	return pstub, nil
+}
+
+type privateCheck struct {
+	Key   string `json:"key"`
+	Match bool   `json:"match"`
+}
+
+// privateDataError turns the error of a private data call into one that
+// tells the likely cause: the peer fails the same way whether the
+// collection does not exist or the organization of the caller is not a
+// member of it
+func privateDataError(stub shim.ChaincodeStubInterface, collection string, err error) error {
+	mspID, _ := callerMSPID(stub)
+	return errorf(codeForbidden, "Collection %s is not defined or %s is not a member of it: %s", collection, mspID, err)
+}
+
+// privateHash returns the hex encoded SHA-256 of a private value
+func (t *SimpleAsset) privateHash(value []byte) (string, error) {
+	h, err := t.bccspInst.Hash(value, &bccsp.SHA256Opts{})
+	if err != nil {
+		return "", fmt.Errorf("bccspInst.Hash failed, err %s", err)
+	}
+	return hex.EncodeToString(h), nil
+}
+
+// addPrivateRecord stores the json Record passed through the transient
+// field in the private data collection args[0] under the ids in args[1:3].
+// Only the SHA-256 of the stored document reaches the channel ledger,
+// and it is what is returned, since the response is part of the
+// transaction as well
+func (t *SimpleAsset) addPrivateRecord(stub shim.ChaincodeStubInterface, args []string, record []byte) (string, error) {
+	if len(args) != 3 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a collection and a key")
+	}
+	pstub, err := getPrivateDataStub(stub)
+	if err != nil {
+		return "", err
+	}
+	collection := args[0]
+	key, err := resolveKey(stub, args[1], args[2], true)
+	if err != nil {
+		return "", err
+	}
+	value, err := makeRecord(stub, key, []string{args[1], args[2], string(record)})
+	if err != nil {
+		return "", errorf(codeBadRequest, "Incorrect arguments. %s", err)
+	}
+	err = checkIssuer(stub, value)
+	if err != nil {
+		return "", err
+	}
+	err = checkWriter(stub, key)
+	if err != nil {
+		return "", err
+	}
+
+	hashKey, err := recordIndexKey(stub, privateHashIndex, key, collection)
+	if err != nil {
+		return "", err
+	}
+	previous, err := stub.GetState(hashKey)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[1], err)
+	}
+	eventName := recordAddedEvent
+	if previous != nil {
+		eventName = recordUpdatedEvent
+	}
+	event, err := newRecordEvent(stub, eventName, key)
+	if err != nil {
+		return "", err
+	}
+
+	err = pstub.PutPrivateData(collection, key, []byte(value))
+	if err != nil {
+		return "", privateDataError(stub, collection, err)
+	}
+	hash, err := t.privateHash([]byte(value))
+	if err != nil {
+		return "", err
+	}
+	err = stub.PutState(hashKey, []byte(hash))
+	if err != nil {
+		return "", fmt.Errorf("Failed to set asset: %s", args[1])
+	}
+	err = trackModifier(stub, key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to track modifier of asset: %s with error: %s", args[1], err)
+	}
+	err = emitEvent(stub, event)
+	if err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// getPrivateRecord returns the json document of the record at args[1:3]
+// in the private data collection args[0]
+func getPrivateRecord(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 3 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a collection and a key")
+	}
+	pstub, err := getPrivateDataStub(stub)
+	if err != nil {
+		return "", err
+	}
+	key, err := resolveKey(stub, args[1], args[2], false)
+	if err != nil {
+		return "", err
+	}
+	value, err := pstub.GetPrivateData(args[0], key)
+	if err != nil {
+		return "", privateDataError(stub, args[0], err)
+	}
+	err = checkReader(stub, key, args[1], value)
+	if err != nil {
+		return "", err
+	}
+	if value == nil {
+		return "", errorf(codeNotFound, "Asset not found: %s", args[1])
+	}
+	result, err := parseRecord(value)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[1], err)
+	}
+	return result, nil
+}
+
+// verifyPrivateRecord reports whether the candidate document in args[3]
+// is the record at args[1:3] in the private data collection args[0], by
+// comparing its hash with the one on the channel ledger; it needs no
+// access to the collection. The candidate has to be the document exactly
+// as stored, e.g. as returned by getPrivateRecord, and since the
+// arguments are part of the transaction this is meant for queries
+func (t *SimpleAsset) verifyPrivateRecord(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 4 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a collection, a key and a candidate record")
+	}
+	key, err := resolveKey(stub, args[1], args[2], false)
+	if err != nil {
+		return "", err
+	}
+	hashKey, err := recordIndexKey(stub, privateHashIndex, key, args[0])
+	if err != nil {
+		return "", err
+	}
+	stored, err := stub.GetState(hashKey)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[1], err)
+	}
+	if stored == nil {
+		return "", errorf(codeNotFound, "Asset not found: %s", args[1])
+	}
+	hash, err := t.privateHash([]byte(args[3]))
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(privateCheck{key, hash == string(stored)})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
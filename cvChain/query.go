@@ -0,0 +1,558 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/entities"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxPageSize bounds the number of records a single page may hold
+	maxPageSize = 1000
+	// maxKey sorts after any record key; it serves as the end key of
+	// open-ended range queries
+	maxKey = string(utf8.MaxRune)
+)
+
+// parsePageSize parses and validates a page size argument
+func parsePageSize(arg string) (int, error) {
+	pageSize, err := strconv.Atoi(arg)
+	if err != nil || pageSize <= 0 || pageSize > maxPageSize {
+		return 0, errorf(codeBadRequest, "Invalid page size %s, must be between 1 and %d", arg, maxPageSize)
+	}
+	return pageSize, nil
+}
+
+// getRecordsByRangeNDJSON returns the records whose keys fall between
+// args[0] (inclusive) and args[1] (exclusive) as newline-delimited json,
+// one keyValuePair per line, so that clients can parse the response as
+// a stream instead of holding a whole json array in memory
+func getRecordsByRangeNDJSON(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a start key and an end key")
+	}
+
+	var buf bytes.Buffer
+	err := forEachRecordInRange(stub, args[0], args[1], readable(stub, func(key string, value []byte) error {
+		line, err := json.Marshal(keyValuePair{key, string(value)})
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		return nil
+	}))
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// getRecordsByRange returns a json-marshalled list of the records whose
+// keys fall between args[0] (inclusive) and args[1] (exclusive), with
+// their stored documents. All the records of an owner are returned by
+// listRecordsByOwner, and a page of either plaintext or encrypted records
+// by getNamespacePage
+func getRecordsByRange(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a start key and an end key")
+	}
+
+	records := []keyValuePair{}
+	err := forEachRecordInRange(stub, args[0], args[1], readable(stub, func(key string, value []byte) error {
+		records = append(records, keyValuePair{key, string(value)})
+		return nil
+	}))
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(records)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// responseMetadata mirrors the metadata Fabric returns with a page of a
+// paginated query
+type responseMetadata struct {
+	FetchedRecordsCount int    `json:"fetchedRecordsCount"`
+	Bookmark            string `json:"bookmark"`
+}
+
+type recordsPage struct {
+	Records  []keyValuePair   `json:"records"`
+	Metadata responseMetadata `json:"metadata"`
+}
+
+// getRecordsByRangePaginated returns a page of at most args[2] of the
+// records getRecordsByRange would return for the range from args[0] to
+// args[1], starting at the bookmark in args[3] if any, along with the
+// bookmark of the next page. The shim this chaincode is built against
+// predates GetStateByRangeWithPagination, so the bookmark is simply the
+// key the next page starts at, found by reading one record past the
+// page. An empty bookmark means there are no more records
+func getRecordsByRangePaginated(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) < 3 || len(args) > 4 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a start key, an end key, a page size and optionally a bookmark")
+	}
+	bookmark := ""
+	if len(args) == 4 {
+		bookmark = args[3]
+	}
+	return getRecordsPage(stub, args[0], args[1], args[2], bookmark)
+}
+
+// listRecords returns a page of at most args[0] of all the records, in
+// key order, starting at the bookmark in args[1] if any, like
+// getRecordsByRangePaginated does for a range. An empty page with an
+// empty bookmark means there are no more records
+func listRecords(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a page size and optionally a bookmark")
+	}
+	bookmark := ""
+	if len(args) == 2 {
+		bookmark = args[1]
+	}
+	return getRecordsPage(stub, "", "", args[0], bookmark)
+}
+
+// getRecordsPage returns the json-marshalled page of at most pageSize of
+// the records from start to end that the caller may read, starting at
+// bookmark if it is past start
+func getRecordsPage(stub shim.ChaincodeStubInterface, start, end, pageSize, bookmark string) (string, error) {
+	size, err := parsePageSize(pageSize)
+	if err != nil {
+		return "", err
+	}
+	if bookmark > start {
+		start = bookmark
+	}
+
+	page := recordsPage{Records: []keyValuePair{}}
+	err = forEachRecordInRange(stub, start, end, readable(stub, func(key string, value []byte) error {
+		if len(page.Records) == size {
+			page.Metadata.Bookmark = key
+			return errStopIteration
+		}
+		page.Records = append(page.Records, keyValuePair{key, string(value)})
+		return nil
+	}))
+	if err != nil {
+		return "", err
+	}
+	page.Metadata.FetchedRecordsCount = len(page.Records)
+
+	b, err := json.Marshal(page)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// namespacedRecord is a record of the page getNamespacePage returns: a
+// plaintext record with its document, or an encrypted one with its base64
+// encoded ciphertext, the time of the transaction that created it and,
+// once decrypted, its document
+type namespacedRecord struct {
+	Key        string          `json:"key"`
+	Ciphertext string          `json:"ciphertext,omitempty"`
+	CreatedAt  string          `json:"createdAt,omitempty"`
+	Record     json.RawMessage `json:"record,omitempty"`
+}
+
+type namespacePage struct {
+	Records  []namespacedRecord `json:"records"`
+	Skipped  []decryptFailure   `json:"skipped"`
+	Metadata responseMetadata   `json:"metadata"`
+}
+
+// decryptStored decrypts the ciphertext stored at key with ent, holding
+// the key with the supplied fingerprint, and returns the record document
+func decryptStored(stub shim.ChaincodeStubInterface, ent entities.Encrypter, fingerprint, key string, ciphertext []byte) (string, error) {
+	indexKey, err := recordIndexKey(stub, encIndex, key)
+	if err != nil {
+		return "", err
+	}
+	stored, err := stub.GetState(indexKey)
+	if err != nil {
+		return "", err
+	}
+	if stored != nil && string(stored) != fingerprint {
+		return "", errorf(codeCryptoError, "encrypted under a different key")
+	}
+	plaintext, err := ent.Decrypt(ciphertext)
+	if err != nil {
+		return "", errors.WithMessage(err, "decryption failed")
+	}
+	return parseRecord(plaintext)
+}
+
+// getNamespacePage returns a page of at most args[3] of the records
+// stored under the object type in args[0], recordIndex or encRecordIndex,
+// whose keys fall between args[1] (inclusive) and args[2] (exclusive, or
+// open-ended if empty), starting at the bookmark in args[4] if any, as
+// getRecordsByRangePaginated does, so that a page never mixes plaintext
+// and ciphertext. Encrypted records are decrypted with decKey if one is
+// supplied. Records that fail to decrypt or to parse are skipped and
+// reported instead of failing the page, as are those encrypted before
+// encrypted records were kept apart, which stay among the plaintext ones
+// until written again; records the caller may not read are left out.
+// The creation times come from the history, so it is meant for read-only
+// queries
+func (t *SimpleAsset) getNamespacePage(stub shim.ChaincodeStubInterface, args []string, decKey []byte) (string, error) {
+	if len(args) < 4 || len(args) > 5 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting an object type, a start key, an end key, a page size and optionally a bookmark")
+	}
+	objectType := args[0]
+	if objectType != recordIndex && objectType != encRecordIndex {
+		return "", errorf(codeBadRequest, "Invalid object type %s, expecting %s or %s", objectType, recordIndex, encRecordIndex)
+	}
+	size, err := parsePageSize(args[3])
+	if err != nil {
+		return "", err
+	}
+	start := args[1]
+	if len(args) == 5 && args[4] > start {
+		start = args[4]
+	}
+
+	var ent entities.Encrypter
+	fingerprint := ""
+	if objectType == encRecordIndex && decKey != nil {
+		ent, err = entities.NewAES256EncrypterEntity("ID", t.bccspInst, decKey, nil)
+		if err != nil {
+			return "", errorf(codeCryptoError, "entities.NewAES256EncrypterEntity failed, err %s", err)
+		}
+		fingerprint, err = t.keyFingerprint(decKey)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	page := namespacePage{Records: []namespacedRecord{}, Skipped: []decryptFailure{}}
+	err = forEachRecordInNamespace(stub, objectType, start, args[2], func(key string, value []byte) error {
+		if len(page.Records)+len(page.Skipped) == size {
+			page.Metadata.Bookmark = key
+			return errStopIteration
+		}
+		owner, _ := splitKey(stub, key)
+		if checkReader(stub, key, owner, value) != nil {
+			return nil
+		}
+
+		rec := namespacedRecord{Key: key}
+		if objectType == recordIndex {
+			encrypted, err := isEncrypted(stub, key)
+			if err != nil {
+				return err
+			}
+			if encrypted {
+				page.Skipped = append(page.Skipped, decryptFailure{key, "encrypted before encrypted records were kept apart, to be written again"})
+				return nil
+			}
+			doc, err := parseRecord(value)
+			if err != nil {
+				page.Skipped = append(page.Skipped, decryptFailure{key, err.Error()})
+				return nil
+			}
+			rec.Record = json.RawMessage(doc)
+			page.Records = append(page.Records, rec)
+			return nil
+		}
+
+		rec.Ciphertext = base64.StdEncoding.EncodeToString(value)
+		created, err := creationTimestamp(stub, key)
+		if err != nil {
+			return fmt.Errorf("Failed to get history of %s: %s", key, err)
+		}
+		rec.CreatedAt = created
+		if ent != nil {
+			doc, err := decryptStored(stub, ent, fingerprint, key, value)
+			if err != nil {
+				page.Skipped = append(page.Skipped, decryptFailure{key, err.Error()})
+				return nil
+			}
+			rec.Record = json.RawMessage(doc)
+		}
+		page.Records = append(page.Records, rec)
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return "", err
+	}
+	page.Metadata.FetchedRecordsCount = len(page.Records) + len(page.Skipped)
+
+	b, err := json.Marshal(page)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// listRecordsByOwner returns a json-marshalled list of the records whose
+// first id is args[0], with their stored documents
+func listRecordsByOwner(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting an owner")
+	}
+
+	records := []keyValuePair{}
+	err := forEachOwnerRecord(stub, args[0], readable(stub, func(key string, value []byte) error {
+		records = append(records, keyValuePair{key, string(value)})
+		return nil
+	}))
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(records)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+type scanPage struct {
+	Records []keyValuePair `json:"records"`
+	Cursor  string         `json:"cursor"`
+}
+
+// scanWithCursor returns a page of at most args[0] records in key order,
+// starting after the position encoded by the cursor in args[1] (or at the
+// beginning if there is none), together with the cursor to pass to get
+// the next page. The cursor is opaque to clients; it encodes the last key
+// returned. An empty cursor in the response means the scan is complete
+func scanWithCursor(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a page size and optionally a cursor")
+	}
+	pageSize, err := parsePageSize(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	startKey := ""
+	if len(args) == 2 && args[1] != "" {
+		lastKey, err := base64.StdEncoding.DecodeString(args[1])
+		if err != nil {
+			return "", errorf(codeBadRequest, "Invalid cursor %s", args[1])
+		}
+		// the smallest key sorting after the last one returned
+		startKey = string(lastKey) + "\x00"
+	}
+
+	page := scanPage{Records: []keyValuePair{}}
+	err = forEachRecordInRange(stub, startKey, "", readable(stub, func(key string, value []byte) error {
+		page.Records = append(page.Records, keyValuePair{key, string(value)})
+		if len(page.Records) == pageSize {
+			return errStopIteration
+		}
+		return nil
+	}))
+	if err != nil {
+		return "", err
+	}
+	if len(page.Records) == pageSize {
+		page.Cursor = base64.StdEncoding.EncodeToString([]byte(page.Records[pageSize-1].Key))
+	}
+
+	b, err := json.Marshal(page)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+type recordWithNeighbors struct {
+	keyValuePair
+	Previous string `json:"previous"`
+	Next     string `json:"next"`
+}
+
+// getRecordWithNeighbors returns a record along with the keys of the
+// records immediately before and after it in key order among the records
+// of the same owner, so that both lookups stay within the owner's key
+// range. The previous or next key is empty at either end of the range.
+// Composite keys cannot be range queried, and range queries only run
+// forward, so the records of the owner are read from the first one up to
+// the one after the key: it is meant for read-only queries, as its read
+// set grows with the records of the owner
+func getRecordWithNeighbors(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key")
+	}
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	if len(value) == 0 {
+		value = nil
+	}
+	// checked before telling whether the record exists
+	owner, _ := splitKey(stub, key)
+	err = checkReader(stub, key, owner, value)
+	if err != nil {
+		return "", err
+	}
+	if value == nil {
+		return "", errorf(codeNotFound, "Asset not found: %s", args[0])
+	}
+
+	res := recordWithNeighbors{keyValuePair: keyValuePair{key, string(value)}}
+
+	// the previous key is the last one found before the key, and the
+	// next key the first one after it
+	found := false
+	err = forEachOwnerRecord(stub, owner, readable(stub, func(k string, v []byte) error {
+		switch {
+		case k == key:
+			found = true
+		case found:
+			res.Next = k
+			return errStopIteration
+		default:
+			res.Previous = k
+		}
+		return nil
+	}))
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// recordQuery holds the criteria queryRecords accepts; empty criteria
+// match any record
+type recordQuery struct {
+	Owner  string `json:"owner"`
+	Issuer string `json:"issuer"`
+	// Status is "active" or "revoked"
+	Status string `json:"status"`
+}
+
+// selector returns the CouchDB query matching the record documents that
+// meet the criteria. Other json documents of the namespace are left out
+// by requiring the fields every record has
+func (q *recordQuery) selector() ([]byte, error) {
+	selector := map[string]interface{}{
+		"issuer": map[string]bool{"$exists": true},
+		"title":  map[string]bool{"$exists": true},
+	}
+	if q.Owner != "" {
+		selector["owner"] = q.Owner
+	}
+	if q.Issuer != "" {
+		selector["issuer"] = q.Issuer
+	}
+	switch q.Status {
+	case "":
+	case "active":
+		selector["revoked"] = map[string]bool{"$exists": false}
+	case "revoked":
+		selector["revoked"] = true
+	default:
+		return nil, errorf(codeBadRequest, "Invalid status %s, expecting active or revoked", q.Status)
+	}
+	return json.Marshal(map[string]interface{}{"selector": selector})
+}
+
+type queriedRecord struct {
+	Key    string          `json:"key"`
+	Record json.RawMessage `json:"record"`
+}
+
+// isRecordKey reports whether key is the key of a record, as opposed to
+// that of an index entry or of the configuration
+func isRecordKey(stub shim.ChaincodeStubInterface, key string) bool {
+	if !strings.HasPrefix(key, "\x00") {
+		return isLegacyRecordKey(key)
+	}
+	objectType, attrs, err := stub.SplitCompositeKey(key)
+	return err == nil && (objectType == recordIndex || objectType == encRecordIndex) && len(attrs) == 2
+}
+
+// queryRecords returns a json-marshalled list of the records meeting the
+// criteria of the json recordQuery in args[0], by way of a CouchDB rich
+// query; it fails against a peer using LevelDB. Clients pass criteria
+// rather than a selector, so that queries are limited to record fields.
+// Encrypted records are never matched, and records the caller may not
+// read are left out. The results of rich queries are not re-validated
+// when the transaction commits, so queryRecords must stay read-only and
+// its results must never be used to decide what a transaction writes
+func queryRecords(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a json query")
+	}
+	q := recordQuery{}
+	d := json.NewDecoder(strings.NewReader(args[0]))
+	d.DisallowUnknownFields()
+	err := d.Decode(&q)
+	if err == nil && d.More() {
+		err = errorf(codeBadRequest, "unexpected data after the object")
+	}
+	if err != nil {
+		return "", errorf(codeBadRequest, "Invalid query %s, expecting an object with the owner, issuer or status fields: %s", args[0], err)
+	}
+	query, err := q.selector()
+	if err != nil {
+		return "", err
+	}
+
+	iterator, err := stub.GetQueryResult(string(query))
+	if err != nil {
+		return "", fmt.Errorf("Failed to query records with error: %s", err)
+	}
+	defer iterator.Close()
+
+	records := []queriedRecord{}
+	for iterator.HasNext() {
+		el, err := iterator.Next()
+		if err != nil {
+			return "", err
+		}
+		if !isRecordKey(stub, el.Key) {
+			continue
+		}
+		owner, _ := splitKey(stub, el.Key)
+		if checkReader(stub, el.Key, owner, el.Value) != nil {
+			continue
+		}
+		record, err := parseRecord(el.Value)
+		if err != nil {
+			continue
+		}
+		records = append(records, queriedRecord{el.Key, json.RawMessage(record)})
+	}
+
+	b, err := json.Marshal(records)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,200 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ownerUsage returns the number of records and of value bytes stored
+// under the keys of the supplied owner
+func ownerUsage(stub shim.ChaincodeStubInterface, owner string) (int, int, error) {
+	records, usage := 0, 0
+	err := forEachOwnerRecord(stub, owner, func(key string, value []byte) error {
+		records++
+		usage += len(value)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return records, usage, nil
+}
+
+// checkOwnerQuota returns an error if writing size bytes to key would take
+// the owner of key over the configured storage quota or record limit
+func checkOwnerQuota(stub shim.ChaincodeStubInterface, key string, size int) error {
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+	if cfg.OwnerQuota <= 0 && cfg.OwnerRecordLimit <= 0 {
+		return nil
+	}
+
+	owner, _ := splitKey(stub, key)
+	records, usage, err := ownerUsage(stub, owner)
+	if err != nil {
+		return fmt.Errorf("Failed to compute storage of owner %s: %s", owner, err)
+	}
+
+	// the value being overwritten no longer counts against the quota
+	old, err := stub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to get asset: %s with error: %s", key, err)
+	}
+	if old == nil {
+		records++
+	}
+	usage += size - len(old)
+	return checkOwnerLimits(cfg, owner, records, usage)
+}
+
+// checkOwnerLimits returns an error if owner holding records records of
+// usage bytes in all would exceed the configured storage quota or record
+// limit
+func checkOwnerLimits(cfg *chaincodeConfig, owner string, records, usage int) error {
+	if cfg.OwnerRecordLimit > 0 && records > cfg.OwnerRecordLimit {
+		return errorf(codeForbidden, "Record limit exceeded for owner %s: %d of %d records", owner, records, cfg.OwnerRecordLimit)
+	}
+	if cfg.OwnerQuota > 0 && usage > cfg.OwnerQuota {
+		return errorf(codeForbidden, "Storage quota exceeded for owner %s: %d of %d bytes", owner, usage, cfg.OwnerQuota)
+	}
+	return nil
+}
+
+// batchUsage is the number of records and of value bytes a batch adds to
+// those of an owner
+type batchUsage struct {
+	records int
+	bytes   int
+}
+
+// checkBatchQuota returns an error if adding the usage in added, by owner,
+// to the records of every owner would take one of them over the storage
+// quota or record limit. It is checked before the batch writes anything,
+// since GetState does not see the writes of the current transaction.
+// Owners are checked in order, so that every peer reports the same one
+func checkBatchQuota(stub shim.ChaincodeStubInterface, added map[string]batchUsage) error {
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+	if cfg.OwnerQuota <= 0 && cfg.OwnerRecordLimit <= 0 {
+		return nil
+	}
+
+	owners := make([]string, 0, len(added))
+	for owner := range added {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	for _, owner := range owners {
+		records, usage, err := ownerUsage(stub, owner)
+		if err != nil {
+			return fmt.Errorf("Failed to compute storage of owner %s: %s", owner, err)
+		}
+		err = checkOwnerLimits(cfg, owner, records+added[owner].records, usage+added[owner].bytes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchQuota checks the quota of the owners of a batch whose records are
+// checked and written one at a time. The usage of an owner is read before
+// the first record of the batch is written for it, and the records
+// written since are added to it, since GetState does not see the writes
+// of the current transaction
+type batchQuota struct {
+	cfg   *chaincodeConfig
+	base  map[string]batchUsage
+	added map[string]batchUsage
+}
+
+func newBatchQuota(cfg *chaincodeConfig) *batchQuota {
+	return &batchQuota{cfg: cfg, base: map[string]batchUsage{}, added: map[string]batchUsage{}}
+}
+
+// check returns an error if writing a new record of size bytes to key,
+// after the records added so far, would take the owner of key over the
+// storage quota or record limit
+func (q *batchQuota) check(stub shim.ChaincodeStubInterface, key string, size int) error {
+	if q.cfg.OwnerQuota <= 0 && q.cfg.OwnerRecordLimit <= 0 {
+		return nil
+	}
+
+	owner, _ := splitKey(stub, key)
+	base, in := q.base[owner]
+	if !in {
+		records, usage, err := ownerUsage(stub, owner)
+		if err != nil {
+			return fmt.Errorf("Failed to compute storage of owner %s: %s", owner, err)
+		}
+		base = batchUsage{records: records, bytes: usage}
+		q.base[owner] = base
+	}
+	added := q.added[owner]
+	return checkOwnerLimits(q.cfg, owner, base.records+added.records+1, base.bytes+added.bytes+size)
+}
+
+// add counts a new record of size bytes, written to key, in the usage of
+// its owner
+func (q *batchQuota) add(stub shim.ChaincodeStubInterface, key string, size int) {
+	owner, _ := splitKey(stub, key)
+	usage := q.added[owner]
+	usage.records++
+	usage.bytes += size
+	q.added[owner] = usage
+}
+
+// setOwnerLimit parses a limit from args and, if the caller is the admin,
+// stores it in the configuration through set
+func setOwnerLimit(stub shim.ChaincodeStubInterface, args []string, set func(cfg *chaincodeConfig, limit int)) (string, error) {
+	if len(args) != 1 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a limit")
+	}
+	limit, err := strconv.Atoi(args[0])
+	if err != nil || limit < 0 {
+		return "", errorf(codeBadRequest, "Invalid limit %s", args[0])
+	}
+
+	cfg, err := getConfig(stub)
+	if err != nil {
+		return "", err
+	}
+	err = requireAdmin(stub, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	set(cfg, limit)
+	err = putConfig(stub, cfg)
+	if err != nil {
+		return "", err
+	}
+	return args[0], nil
+}
+
+// setOwnerQuota changes the per-owner storage quota in bytes
+func setOwnerQuota(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	return setOwnerLimit(stub, args, func(cfg *chaincodeConfig, limit int) {
+		cfg.OwnerQuota = limit
+	})
+}
+
+// setOwnerRecordLimit changes the per-owner cap on the number of records
+func setOwnerRecordLimit(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	return setOwnerLimit(stub, args, func(cfg *chaincodeConfig, limit int) {
+		cfg.OwnerRecordLimit = limit
+	})
+}
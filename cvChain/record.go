@@ -0,0 +1,146 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/pkg/errors"
+)
+
+// Record is a CV record, stored on the ledger as a json document
+type Record struct {
+	Owner   string `json:"owner"`
+	Issuer  string `json:"issuer"`
+	Title   string `json:"title"`
+	Content string `json:"content,omitempty"`
+	// IssuedAt is an RFC3339 timestamp
+	IssuedAt string `json:"issuedAt,omitempty"`
+	// the revocation is set by revokeRecord only
+	Revoked          bool   `json:"revoked,omitempty"`
+	RevokedAt        string `json:"revokedAt,omitempty"`
+	RevocationReason string `json:"revocationReason,omitempty"`
+	// the version and timestamps are set by the chaincode: Version starts
+	// at 1 and is incremented by every updateRecord and restoreSnapshot,
+	// and the timestamps are RFC3339 ones of the transactions that created
+	// and last wrote the record
+	Version   int    `json:"version,omitempty"`
+	CreatedAt string `json:"createdAt,omitempty"`
+	UpdatedAt string `json:"updatedAt,omitempty"`
+}
+
+// validate returns an error if a required field of the record is missing
+// or a field is malformed. The owner is not required since it is taken
+// from the key
+func (r *Record) validate() error {
+	switch {
+	case r.Issuer == "":
+		return errorf(codeBadRequest, "missing issuer")
+	case r.Title == "":
+		return errorf(codeBadRequest, "missing title")
+	}
+	if r.IssuedAt != "" {
+		_, err := time.Parse(time.RFC3339, r.IssuedAt)
+		if err != nil {
+			return errorf(codeBadRequest, "invalid issuedAt %s, expecting an RFC3339 timestamp", r.IssuedAt)
+		}
+	}
+	return nil
+}
+
+// makeRecord parses and validates the json record document in args[2],
+// written under the ids in args[0:2] that resolved to key, and returns
+// the document to store as the first version of the record. The owner
+// may be left out of the document, but must match the first id if given;
+// it is stored as the first id of key, whose case may differ when
+// case-insensitive ids are enabled
+func makeRecord(stub shim.ChaincodeStubInterface, key string, args []string) (string, error) {
+	r, err := newRecord(stub, key, args)
+	if err != nil {
+		return "", err
+	}
+	return r.document()
+}
+
+// newRecord returns the record makeRecord stores
+func newRecord(stub shim.ChaincodeStubInterface, key string, args []string) (*Record, error) {
+	owner, _ := splitKey(stub, key)
+	return newOwnedRecord(stub, owner, args[0], args[2], "")
+}
+
+// newOwnedRecord returns the first version of the record in the json
+// document doc, written for owner under the id ownerID, which may differ
+// in case. If issuer is set, the document may leave the issuer out but
+// must otherwise name it
+func newOwnedRecord(stub shim.ChaincodeStubInterface, owner, ownerID, doc, issuer string) (*Record, error) {
+	r := &Record{}
+	err := json.Unmarshal([]byte(doc), r)
+	if err != nil {
+		return nil, errorf(codeBadRequest, "invalid record, err %s", err)
+	}
+	if r.Owner != "" && r.Owner != ownerID && r.Owner != owner {
+		return nil, errorf(codeBadRequest, "invalid record, the owner %s does not match the key %s", r.Owner, ownerID)
+	}
+	if issuer != "" {
+		if r.Issuer != "" && r.Issuer != issuer {
+			return nil, errorf(codeForbidden, "access denied: a record written by %s must name it as issuer, got %s", issuer, r.Issuer)
+		}
+		r.Issuer = issuer
+	}
+	if r.Revoked || r.RevokedAt != "" || r.RevocationReason != "" {
+		return nil, errorf(codeBadRequest, "invalid record, records are revoked with revokeRecord")
+	}
+	if r.Version != 0 || r.CreatedAt != "" || r.UpdatedAt != "" {
+		return nil, errorf(codeBadRequest, "invalid record, the version and timestamps are set by the chaincode")
+	}
+	r.Owner = owner
+	err = r.validate()
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid record")
+	}
+
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, errors.WithMessage(err, "could not get transaction timestamp")
+	}
+	r.Version = 1
+	r.CreatedAt = formatTimestamp(ts)
+	r.UpdatedAt = r.CreatedAt
+	return r, nil
+}
+
+// document returns the json document of the record
+func (r *Record) document() (string, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// parseRecord checks that a stored value is a valid record and returns
+// its json document. Values written in the colon-delimited format of
+// earlier versions are rejected; Init converts them when migrating
+func parseRecord(stored []byte) (string, error) {
+	r := Record{}
+	err := json.Unmarshal(stored, &r)
+	if err != nil {
+		return "", errorf(codeBadRequest, "invalid record: not a json document, it may predate json records and have to be written again")
+	}
+	err = r.validate()
+	if err != nil {
+		return "", errors.WithMessage(err, "invalid record")
+	}
+
+	b, err := json.Marshal(&r)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,239 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/entities"
+	"github.com/pkg/errors"
+)
+
+// aes256KeySize is the size in bytes of the keys of the AES entities
+const aes256KeySize = 32
+
+type rotationReport struct {
+	Rotated int              `json:"rotated"`
+	Keys    []string         `json:"keys"`
+	Skipped []decryptFailure `json:"skipped"`
+}
+
+// checkRotationKeys returns an error unless the old and the new keys of a
+// rotation are distinct AES 256 bit keys
+func checkRotationKeys(decKey, encKey []byte) error {
+	if len(decKey) != aes256KeySize {
+		return errorf(codeBadRequest, "Expected transient decryption key %s of %d bytes, got %d", DECKEY, aes256KeySize, len(decKey))
+	}
+	if len(encKey) != aes256KeySize {
+		return errorf(codeBadRequest, "Expected transient encryption key %s of %d bytes, got %d", ENCKEY, aes256KeySize, len(encKey))
+	}
+	if bytes.Equal(decKey, encKey) {
+		return errorf(codeBadRequest, "The transient keys %s and %s are the same", DECKEY, ENCKEY)
+	}
+	return nil
+}
+
+// decryptForRotation returns the plaintext of the record at key, checking
+// that it is encrypted under the key of oldEnt, whose fingerprint is
+// oldFingerprint, and that the caller may write the record again
+func decryptForRotation(stub shim.ChaincodeStubInterface, oldEnt entities.Encrypter, oldFingerprint, key string) ([]byte, error) {
+	indexKey, err := recordIndexKey(stub, encIndex, key)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint, err := stub.GetState(indexKey)
+	if err != nil {
+		return nil, err
+	}
+	if fingerprint == nil {
+		return nil, errors.New("not encrypted")
+	}
+	// a wrong key may still happen to decrypt to validly padded garbage
+	if string(fingerprint) != oldFingerprint {
+		return nil, errorf(codeCryptoError, "encrypted under a different key")
+	}
+	plaintext, err := getStateAndDecrypt(stub, oldEnt, key)
+	if err != nil {
+		return nil, errors.WithMessage(err, "decryption failed")
+	}
+	err = checkWriter(stub, key)
+	if err != nil {
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// putRotated writes the plaintext of the record at key encrypted with
+// newEnt, holding encKey, and returns the event of the write for the
+// caller to emit. The plaintext never leaves the chaincode; the metadata
+// of the previous value is replaced as for any encrypted write, which
+// drops a signature made over the old ciphertext, but the digest of the
+// unchanged document is kept
+func (t *SimpleAsset) putRotated(stub shim.ChaincodeStubInterface, newEnt entities.Encrypter, encKey []byte, key string, plaintext []byte) (recordEvent, error) {
+	event, err := newRecordEvent(stub, recordUpdatedEvent, key)
+	if err != nil {
+		return recordEvent{}, err
+	}
+	digestKey, err := recordIndexKey(stub, digestIndex, key)
+	if err != nil {
+		return recordEvent{}, err
+	}
+	digest, err := stub.GetState(digestKey)
+	if err != nil {
+		return recordEvent{}, err
+	}
+	event.Encrypted = true
+	err = encryptAndPutState(stub, newEnt, key, plaintext)
+	if err != nil {
+		return recordEvent{}, errors.WithMessage(err, "encryptAndPutState failed")
+	}
+	err = t.trackEncrypted(stub, key, encKey, plaintext)
+	if err != nil {
+		return recordEvent{}, errors.WithMessage(err, "trackEncrypted failed")
+	}
+	if digest != nil {
+		err = stub.PutState(digestKey, digest)
+		if err != nil {
+			return recordEvent{}, err
+		}
+	}
+	err = trackModifier(stub, key)
+	if err != nil {
+		return recordEvent{}, errors.WithMessage(err, "trackModifier failed")
+	}
+	return event, nil
+}
+
+// reEncryptRecord rotates the key of the encrypted asset at args[0:2]: the
+// record is decrypted with decKey and written again encrypted with encKey,
+// with IV if one is supplied. The fingerprint of the new key is returned.
+// Snapshots of the record keep the ciphertext they were taken of
+func (t *SimpleAsset) reEncryptRecord(stub shim.ChaincodeStubInterface, args []string, decKey, encKey, IV []byte) (string, error) {
+	if len(args) != 2 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key")
+	}
+	err := checkRotationKeys(decKey, encKey)
+	if err != nil {
+		return "", err
+	}
+	oldEnt, err := entities.NewAES256EncrypterEntity("ID", t.bccspInst, decKey, nil)
+	if err != nil {
+		return "", errorf(codeCryptoError, "entities.NewAES256EncrypterEntity failed, err %s", err)
+	}
+	newEnt, err := entities.NewAES256EncrypterEntity("ID", t.bccspInst, encKey, IV)
+	if err != nil {
+		return "", errorf(codeCryptoError, "entities.NewAES256EncrypterEntity failed, err %s", err)
+	}
+	oldFingerprint, err := t.keyFingerprint(decKey)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	if value == nil {
+		return "", errorf(codeNotFound, "Asset not found: %s", args[0])
+	}
+	plaintext, err := decryptForRotation(stub, oldEnt, oldFingerprint, key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to re-encrypt asset: %s with error: %s", args[0], err)
+	}
+	event, err := t.putRotated(stub, newEnt, encKey, key, plaintext)
+	if err != nil {
+		return "", fmt.Errorf("Failed to re-encrypt asset: %s with error: %s", args[0], err)
+	}
+	err = emitEvent(stub, event)
+	if err != nil {
+		return "", err
+	}
+	return t.keyFingerprint(encKey)
+}
+
+// reEncryptRange rotates the key of every encrypted record whose first id
+// is args[0] or, without arguments, of every encrypted record. Records
+// that are not encrypted under decKey, fail to decrypt or may not be
+// written by the caller are skipped and listed in the report, along with
+// the keys rotated. Every record gets a random IV; a fixed one would be
+// reused across the range
+func (t *SimpleAsset) reEncryptRange(stub shim.ChaincodeStubInterface, args []string, decKey, encKey []byte) (string, error) {
+	if len(args) > 1 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting at most an owner")
+	}
+	err := checkRotationKeys(decKey, encKey)
+	if err != nil {
+		return "", err
+	}
+	oldEnt, err := entities.NewAES256EncrypterEntity("ID", t.bccspInst, decKey, nil)
+	if err != nil {
+		return "", errorf(codeCryptoError, "entities.NewAES256EncrypterEntity failed, err %s", err)
+	}
+	newEnt, err := entities.NewAES256EncrypterEntity("ID", t.bccspInst, encKey, nil)
+	if err != nil {
+		return "", errorf(codeCryptoError, "entities.NewAES256EncrypterEntity failed, err %s", err)
+	}
+	oldFingerprint, err := t.keyFingerprint(decKey)
+	if err != nil {
+		return "", err
+	}
+
+	// the records are gathered before any of them is written
+	keys := []string{}
+	collect := func(key string, value []byte) error {
+		encrypted, err := isEncrypted(stub, key)
+		if encrypted {
+			keys = append(keys, key)
+		}
+		return err
+	}
+	if len(args) == 1 {
+		err = forEachOwnerRecord(stub, args[0], collect)
+	} else {
+		err = forEachRecordInRange(stub, "", "", collect)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	report := rotationReport{Keys: []string{}, Skipped: []decryptFailure{}}
+	events := []recordEvent{}
+	for _, key := range keys {
+		plaintext, err := decryptForRotation(stub, oldEnt, oldFingerprint, key)
+		if err != nil {
+			report.Skipped = append(report.Skipped, decryptFailure{key, err.Error()})
+			continue
+		}
+		// unlike the checks above, a failed write fails the whole range
+		event, err := t.putRotated(stub, newEnt, encKey, key, plaintext)
+		if err != nil {
+			return "", fmt.Errorf("Failed to re-encrypt asset: %s with error: %s", key, err)
+		}
+		report.Rotated++
+		report.Keys = append(report.Keys, key)
+		events = append(events, event)
+	}
+	if len(events) > 0 {
+		err = emitEvents(stub, events)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,215 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// the functions below scan the whole ledger to build reports; they are
+// meant for read-only queries, as their read set grows with the ledger
+
+// forEachRecord calls fn with the key and value of every record on the
+// ledger, skipping the configuration and composite index keys
+func forEachRecord(stub shim.ChaincodeStubInterface, fn func(key string, value []byte) error) error {
+	return forEachRecordInRange(stub, "", "", fn)
+}
+
+// storageByOwner returns a json-marshalled map from owner, i.e. the first
+// id of a record key, to the total number of value bytes stored for it
+func storageByOwner(stub shim.ChaincodeStubInterface) (string, error) {
+	usage := map[string]int{}
+	err := forEachRecord(stub, func(key string, value []byte) error {
+		owner, _ := splitKey(stub, key)
+		usage[owner] += len(value)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	bytes, err := json.Marshal(usage)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+type encryptionCounts struct {
+	Plaintext int `json:"plaintext"`
+	Encrypted int `json:"encrypted"`
+}
+
+// encryptionByOwnerReport returns a json-marshalled map from owner to the
+// number of its plaintext and encrypted records, as told by the index of
+// encrypted records
+func encryptionByOwnerReport(stub shim.ChaincodeStubInterface) (string, error) {
+	encrypted := map[string]bool{}
+	iterator, err := stub.GetStateByPartialCompositeKey(encIndex, []string{})
+	if err != nil {
+		return "", err
+	}
+	defer iterator.Close()
+	for iterator.HasNext() {
+		el, err := iterator.Next()
+		if err != nil {
+			return "", err
+		}
+		_, attrs, err := stub.SplitCompositeKey(el.Key)
+		if err != nil {
+			return "", err
+		}
+		key, err := keyFromAttributes(stub, attrs)
+		if err != nil {
+			return "", err
+		}
+		encrypted[key] = true
+	}
+
+	report := map[string]*encryptionCounts{}
+	err = forEachRecord(stub, func(key string, value []byte) error {
+		owner, _ := splitKey(stub, key)
+		counts, in := report[owner]
+		if !in {
+			counts = &encryptionCounts{}
+			report[owner] = counts
+		}
+		if encrypted[key] {
+			counts.Encrypted++
+		} else {
+			counts.Plaintext++
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	bytes, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+type keyCollision struct {
+	Key    string      `json:"key"`
+	Splits [][2]string `json:"splits"`
+}
+
+// detectKeyCollisions returns the legacy record keys that more than one
+// pair of ids maps to because an id contains the separator, along with
+// every such pair: addRecord("a", "b:c") and addRecord("a:b", "c") both
+// wrote "a:b:c". Records keyed by composite keys cannot collide
+func detectKeyCollisions(stub shim.ChaincodeStubInterface) (string, error) {
+	collisions := []keyCollision{}
+	err := forEachRecord(stub, func(key string, value []byte) error {
+		if !isLegacyRecordKey(key) {
+			return nil
+		}
+		parts := strings.Split(key, ":")
+		if len(parts) <= 2 {
+			return nil
+		}
+
+		c := keyCollision{Key: key}
+		for i := 1; i < len(parts); i++ {
+			c.Splits = append(c.Splits, [2]string{
+				strings.Join(parts[:i], ":"),
+				strings.Join(parts[i:], ":"),
+			})
+		}
+		collisions = append(collisions, c)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	bytes, err := json.Marshal(collisions)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+// indexes lists the object types of all the composite key indexes the
+// chaincode maintains
+var indexes = []string{
+	foldIndex, encIndex, escrowIndex, sigIndex, modifierIndex,
+	modifiedByIndex, creatorIndex, benchIndex, seqIndex, snapIndex,
+	deletedIndex, privateHashIndex, digestIndex, grantIndex, issuerIndex, entryIndex, entrySeqIndex,
+}
+
+type storageStats struct {
+	Count int `json:"count"`
+	Bytes int `json:"bytes"`
+}
+
+type indexOverhead struct {
+	Records storageStats            `json:"records"`
+	Indexes map[string]storageStats `json:"indexes"`
+	// Ratio is the index bytes per record byte
+	Ratio float64 `json:"ratio"`
+}
+
+// indexOverheadReport counts the records and the entries of every index,
+// estimating the footprint of each entry as the size of its key and value,
+// and reports the index bytes relative to the record bytes
+func indexOverheadReport(stub shim.ChaincodeStubInterface) (string, error) {
+	report := indexOverhead{Indexes: map[string]storageStats{}}
+	err := forEachRecord(stub, func(key string, value []byte) error {
+		report.Records.Count++
+		report.Records.Bytes += len(key) + len(value)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	indexBytes := 0
+	for _, index := range indexes {
+		stats, err := indexStats(stub, index)
+		if err != nil {
+			return "", err
+		}
+		report.Indexes[index] = stats
+		indexBytes += stats.Bytes
+	}
+	if report.Records.Bytes > 0 {
+		report.Ratio = float64(indexBytes) / float64(report.Records.Bytes)
+	}
+
+	bytes, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+// indexStats returns the number and footprint of the entries of index
+func indexStats(stub shim.ChaincodeStubInterface, index string) (storageStats, error) {
+	stats := storageStats{}
+	iterator, err := stub.GetStateByPartialCompositeKey(index, []string{})
+	if err != nil {
+		return stats, err
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		el, err := iterator.Next()
+		if err != nil {
+			return stats, err
+		}
+		stats.Count++
+		stats.Bytes += len(el.Key) + len(el.Value)
+	}
+	return stats, nil
+}
@@ -0,0 +1,108 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// the codes of the response envelope; clients may rely on them, unlike
+// on the messages
+const (
+	codeOK          = "OK"
+	codeBadRequest  = "BAD_REQUEST"
+	codeNotFound    = "NOT_FOUND"
+	codeForbidden   = "FORBIDDEN"
+	codeConflict    = "CONFLICT"
+	codeCryptoError = "CRYPTO_ERROR"
+	codeInternal    = "INTERNAL"
+)
+
+// envelope is the json payload of every response of the chaincode. Data
+// holds the result of a successful call: a json object or array as is,
+// a binary result, such as the ciphertext of an encrypted record, as the
+// json string of its base64 encoding and any other result as a json string
+type envelope struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// codedError is an error carrying the code it is reported with
+type codedError struct {
+	code string
+	msg  string
+}
+
+func (e *codedError) Error() string {
+	return e.msg
+}
+
+// errorf returns an error reported with code
+func errorf(code, format string, args ...interface{}) error {
+	return &codedError{code, fmt.Sprintf(format, args...)}
+}
+
+// errorCode returns the code of err, looking through the errors wrapping
+// it with pkg/errors. Errors without one are internal
+func errorCode(err error) string {
+	for err != nil {
+		if e, ok := err.(*codedError); ok {
+			return e.code
+		}
+		cause, ok := err.(interface {
+			Cause() error
+		})
+		if !ok {
+			break
+		}
+		err = cause.Cause()
+	}
+	return codeInternal
+}
+
+// marshalEnvelope returns the json encoding of the envelope
+func marshalEnvelope(code, message string, data json.RawMessage) []byte {
+	b, err := json.Marshal(envelope{code, message, data})
+	if err != nil {
+		// only data can fail to marshal, and it is checked to be valid
+		b, _ = json.Marshal(envelope{Code: codeInternal, Message: err.Error()})
+	}
+	return b
+}
+
+// respond returns a successful response with result as data
+func respond(code, result string) peer.Response {
+	var data json.RawMessage
+	trimmed := strings.TrimSpace(result)
+	switch {
+	case result == "":
+	case (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(result)):
+		data = json.RawMessage(result)
+	case !utf8.ValidString(result):
+		data, _ = json.Marshal([]byte(result))
+	default:
+		data, _ = json.Marshal(result)
+	}
+	return shim.Success(marshalEnvelope(code, "", data))
+}
+
+// fail returns an error response with the message of err. The message is
+// the one of the response as well, for the clients reading it
+func fail(code string, err error) peer.Response {
+	return peer.Response{
+		Status:  shim.ERROR,
+		Message: err.Error(),
+		Payload: marshalEnvelope(code, err.Error(), nil),
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/pkg/errors"
+)
+
+// deletedIndex is the composite key object type of the tombstones left
+// by deleteRecord, so that a deleted record can be told from one that
+// never existed. Writing the record again drops its tombstone
+const deletedIndex = "deleted"
+
+// tombstone is the value of a deletedIndex entry
+type tombstone struct {
+	TxID      string `json:"txId"`
+	DeletedAt string `json:"deletedAt"`
+}
+
+// markDeleted leaves the tombstone of the record at key, deleted by the
+// current transaction
+func markDeleted(stub shim.ChaincodeStubInterface, key string) error {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errors.WithMessage(err, "could not get transaction timestamp")
+	}
+	b, err := json.Marshal(tombstone{TxID: stub.GetTxID(), DeletedAt: formatTimestamp(ts)})
+	if err != nil {
+		return errors.Wrap(err, "could not marshal tombstone")
+	}
+	indexKey, err := recordIndexKey(stub, deletedIndex, key)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(indexKey, b)
+}
+
+// getTombstone returns the tombstone of the record at key, nil if the
+// record has not been deleted
+func getTombstone(stub shim.ChaincodeStubInterface, key string) (*tombstone, error) {
+	indexKey, err := recordIndexKey(stub, deletedIndex, key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := stub.GetState(indexKey)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	t := &tombstone{}
+	err = json.Unmarshal(b, t)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid tombstone")
+	}
+	return t, nil
+}
+
+// checkNotRevoked returns an error if the record at key has been revoked;
+// a revoked record is never written again, since that would silently
+// lift its revocation
+func checkNotRevoked(stub shim.ChaincodeStubInterface, key string) error {
+	value, err := stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	r := Record{}
+	if value == nil || json.Unmarshal(value, &r) != nil {
+		return nil
+	}
+	if r.Revoked {
+		return errorf(codeConflict, "Asset revoked: %s was revoked at %s", key, r.RevokedAt)
+	}
+	return nil
+}
+
+// revokeRecord marks the record at args[0:2] as revoked for the reason in
+// args[2] without deleting it, so that verifiers reading it learn that it
+// no longer holds. Only plaintext records can be revoked, and only once
+func revokeRecord(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 3 || args[2] == "" {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key and a reason")
+	}
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	return revokeKey(stub, key, args[0], args[2])
+}
+
+// revokeKey revokes the record at key, named name in errors, for reason
+func revokeKey(stub shim.ChaincodeStubInterface, key, name, reason string) (string, error) {
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", name, err)
+	}
+	if value == nil {
+		return "", errorf(codeNotFound, "Asset not found: %s", name)
+	}
+	_, err = parseRecord(value)
+	if err != nil {
+		return "", fmt.Errorf("Failed to revoke asset: %s with error: %s", name, err)
+	}
+	r := Record{}
+	err = json.Unmarshal(value, &r)
+	if err != nil {
+		return "", err
+	}
+	if r.Revoked {
+		return "", errorf(codeConflict, "Asset already revoked: %s was revoked at %s", name, r.RevokedAt)
+	}
+	err = checkRecordIssuer(stub, value)
+	if err != nil {
+		return "", err
+	}
+	err = checkWriter(stub, key)
+	if err != nil {
+		return "", err
+	}
+
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return "", fmt.Errorf("Failed to revoke asset: %s with error: %s", name, err)
+	}
+	r.Revoked = true
+	r.RevokedAt = formatTimestamp(ts)
+	r.RevocationReason = reason
+	r.Version++
+	r.UpdatedAt = r.RevokedAt
+	b, err := json.Marshal(&r)
+	if err != nil {
+		return "", err
+	}
+	event, err := newRecordEvent(stub, recordRevokedEvent, key)
+	if err != nil {
+		return "", err
+	}
+	err = stub.PutState(key, b)
+	if err != nil {
+		return "", fmt.Errorf("Failed to set asset: %s", name)
+	}
+	err = clearRecordMeta(stub, key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to set asset: %s", name)
+	}
+	err = trackModifier(stub, key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to track modifier of asset: %s with error: %s", name, err)
+	}
+	err = emitEvent(stub, event)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,53 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// seqIndex is the composite key object type the sequence counters are
+// stored under, keyed by sequence name
+const seqIndex = "seq"
+
+// nextSequence increments the sequence named args[0] and returns its new
+// value formatted as name-NNNN, e.g. INV-0001, for use as a record id.
+// Every call reads and writes the same counter key, so concurrent calls
+// for the same sequence conflict: only the first one to be ordered in a
+// block commits, the others fail MVCC validation and must be resubmitted.
+// Sequences are not meant for high write rates
+func nextSequence(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 1 || args[0] == "" {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a sequence name")
+	}
+	seqKey, err := stub.CreateCompositeKey(seqIndex, []string{args[0]})
+	if err != nil {
+		return "", err
+	}
+
+	b, err := stub.GetState(seqKey)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get sequence: %s with error: %s", args[0], err)
+	}
+	next := uint64(1)
+	if b != nil {
+		current, err := strconv.ParseUint(string(b), 10, 64)
+		if err != nil {
+			return "", errorf(codeBadRequest, "Invalid sequence %s: %s", args[0], b)
+		}
+		next = current + 1
+	}
+
+	err = stub.PutState(seqKey, []byte(strconv.FormatUint(next, 10)))
+	if err != nil {
+		return "", fmt.Errorf("Failed to set sequence: %s", args[0])
+	}
+	return fmt.Sprintf("%s-%04d", args[0], next), nil
+}
@@ -0,0 +1,601 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/hyperledger/fabric/bccsp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/entities"
+	"github.com/pkg/errors"
+)
+
+// the chaincode has no key store of its own: signing keys are handed to
+// it through the transient field, like the encryption keys, so they
+// never reach the ledger
+
+// sigIndex is the composite key object type under which the signature
+// over the stored value of a signed record, the ciphertext if the record
+// is encrypted, is stored
+const sigIndex = "sig"
+
+// importSigningKey imports the supplied PEM encoded ECDSA private key
+func (t *SimpleAsset) importSigningKey(sigKey []byte) (bccsp.Key, error) {
+	bl, _ := pem.Decode(sigKey)
+	if bl == nil {
+		return nil, errors.New("pem.Decode returns nil")
+	}
+
+	k, err := t.bccspInst.KeyImport(bl.Bytes, &bccsp.ECDSAPrivateKeyImportOpts{Temporary: true})
+	if err != nil {
+		return nil, errors.WithMessage(err, "bccspInst.KeyImport failed")
+	}
+	return k, nil
+}
+
+// sign returns the ECDSA signature over the SHA-256 of msg. The signer
+// entities of the entities package can only be built together with an
+// encryption key, so signatures are computed with the bccsp directly
+func (t *SimpleAsset) sign(k bccsp.Key, msg []byte) ([]byte, error) {
+	h, err := t.bccspInst.Hash(msg, &bccsp.SHA256Opts{})
+	if err != nil {
+		return nil, errors.WithMessage(err, "bccspInst.Hash failed")
+	}
+	return t.bccspInst.Sign(k, h, nil)
+}
+
+// importVerificationKey imports the supplied PEM encoded ECDSA public key
+func (t *SimpleAsset) importVerificationKey(verKey []byte) (bccsp.Key, error) {
+	bl, _ := pem.Decode(verKey)
+	if bl == nil {
+		return nil, errors.New("pem.Decode returns nil")
+	}
+
+	k, err := t.bccspInst.KeyImport(bl.Bytes, &bccsp.ECDSAPKIXPublicKeyImportOpts{Temporary: true})
+	if err != nil {
+		return nil, errors.WithMessage(err, "bccspInst.KeyImport failed")
+	}
+	return k, nil
+}
+
+// verify checks the ECDSA signature over the SHA-256 of msg
+func (t *SimpleAsset) verify(k bccsp.Key, signature, msg []byte) (bool, error) {
+	h, err := t.bccspInst.Hash(msg, &bccsp.SHA256Opts{})
+	if err != nil {
+		return false, errors.WithMessage(err, "bccspInst.Hash failed")
+	}
+	return t.bccspInst.Verify(k, signature, h, nil)
+}
+
+// publicKeyPEM returns the PEM encoded public key of the supplied key
+func publicKeyPEM(k bccsp.Key) (string, error) {
+	pub, err := k.PublicKey()
+	if err != nil {
+		return "", err
+	}
+	der, err := pub.Bytes()
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+// encryptSignRecord encrypts the record like Encrypter does and then signs
+// the resulting ciphertext with the supplied ECDSA key, storing the
+// signature next to the record; this way a reader can check who wrote a
+// record before even attempting to decrypt it
+func (t *SimpleAsset) encryptSignRecord(stub shim.ChaincodeStubInterface, args []string, encKey, IV, sigKey []byte) (string, error) {
+	ent, err := entities.NewAES256EncrypterEntity("ID", t.bccspInst, encKey, IV)
+	if err != nil {
+		return "", errorf(codeCryptoError, "entities.NewAES256EncrypterEntity failed, err %s", err)
+	}
+	k, err := t.importSigningKey(sigKey)
+	if err != nil {
+		return "", errorf(codeCryptoError, "importSigningKey failed, err %s", err)
+	}
+
+	if len(args) != 3 {
+		return "", errorf(codeBadRequest, "Expected 3 parameters to function encryptSignRecord")
+	}
+	// GetState does not return the writes of the current transaction,
+	// so the ciphertext is kept at hand to be signed
+	var key string
+	var ciphertext []byte
+	value, event, err := t.putEncrypted(stub, encKey, args, func(written, value string) ([]byte, error) {
+		var err error
+		key = written
+		ciphertext, err = encryptValue(ent)(written, value)
+		return ciphertext, err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signature, err := t.sign(k, ciphertext)
+	if err != nil {
+		return "", errorf(codeCryptoError, "sign failed, err %s", err)
+	}
+	sigKeyName, err := recordIndexKey(stub, sigIndex, key)
+	if err != nil {
+		return "", err
+	}
+	err = stub.PutState(sigKeyName, signature)
+	if err != nil {
+		return "", fmt.Errorf("Failed to set signature of asset: %s", args[0])
+	}
+	err = emitEvent(stub, event)
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// decryptVerifyRecord verifies the signature over the ciphertext of a
+// record written by encryptSignRecord against the supplied PEM encoded
+// public key and, only if it is valid, decrypts the record
+func (t *SimpleAsset) decryptVerifyRecord(stub shim.ChaincodeStubInterface, args []string, decKey, verKey []byte) (string, error) {
+	ent, err := entities.NewAES256EncrypterEntity("ID", t.bccspInst, decKey, nil)
+	if err != nil {
+		return "", errorf(codeCryptoError, "entities.NewAES256EncrypterEntity failed, err %s", err)
+	}
+	k, err := t.importVerificationKey(verKey)
+	if err != nil {
+		return "", errorf(codeCryptoError, "importVerificationKey failed, err %s", err)
+	}
+
+	if len(args) != 2 {
+		return "", errorf(codeBadRequest, "Expected 2 parameters to function decryptVerifyRecord")
+	}
+
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := stub.GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	// the peer treats an empty value as a deleted one
+	if len(ciphertext) == 0 {
+		ciphertext = nil
+	}
+	// checked before telling whether the record exists
+	err = checkReader(stub, key, args[0], ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if ciphertext == nil {
+		return "", errorf(codeNotFound, "Asset not found: %s", args[0])
+	}
+	signature, err := getSignature(stub, key)
+	if err != nil {
+		return "", err
+	}
+
+	ok, err := t.verify(k, signature, ciphertext)
+	if err != nil {
+		return "", errorf(codeCryptoError, "verify failed, err %s", err)
+	}
+	if !ok {
+		return "", errorf(codeCryptoError, "invalid signature")
+	}
+
+	cleartextValue, err := ent.Decrypt(ciphertext)
+	if err != nil {
+		return "", errorf(codeCryptoError, "Decrypt failed, err %s", err)
+	}
+	result, err := parseRecord(cleartextValue)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	return result, nil
+}
+
+// getSignature returns the signature stored for the record at key
+func getSignature(stub shim.ChaincodeStubInterface, key string) ([]byte, error) {
+	sigKeyName, err := recordIndexKey(stub, sigIndex, key)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := stub.GetState(sigKeyName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get signature of asset: %s with error: %s", key, err)
+	}
+	if signature == nil {
+		return nil, errorf(codeNotFound, "Asset is not signed: %s", key)
+	}
+	return signature, nil
+}
+
+// verifyAllSignatures checks the stored signature of every record written
+// by encryptSignRecord, or only of those of the owner in args[0] if one is
+// given, against the supplied PEM encoded public key, and reports the
+// records whose signature no longer matches their value
+func (t *SimpleAsset) verifyAllSignatures(stub shim.ChaincodeStubInterface, args []string, verKey []byte) (string, error) {
+	if len(args) > 1 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting an optional owner")
+	}
+	k, err := t.importVerificationKey(verKey)
+	if err != nil {
+		return "", errorf(codeCryptoError, "importVerificationKey failed, err %s", err)
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(sigIndex, []string{})
+	if err != nil {
+		return "", err
+	}
+	defer iterator.Close()
+
+	report := decryptReport{Failed: []decryptFailure{}}
+	for iterator.HasNext() {
+		el, err := iterator.Next()
+		if err != nil {
+			return "", err
+		}
+		_, attrs, err := stub.SplitCompositeKey(el.Key)
+		if err != nil {
+			return "", err
+		}
+		key, err := keyFromAttributes(stub, attrs)
+		if err != nil {
+			return "", err
+		}
+		if owner, _ := splitKey(stub, key); len(args) == 1 && owner != args[0] {
+			continue
+		}
+
+		value, err := stub.GetState(key)
+		if err != nil {
+			return "", err
+		}
+		report.Checked++
+		ok, err := t.verify(k, el.Value, value)
+		if err != nil {
+			report.Failed = append(report.Failed, decryptFailure{key, err.Error()})
+		} else if !ok {
+			report.Failed = append(report.Failed, decryptFailure{key, "invalid signature"})
+		}
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// signRecord signs the stored value of the asset at args[0:2] with the
+// supplied ECDSA key and stores the signature next to the record, so that
+// verifyRecord can later prove who vouched for the value and that it has
+// not been changed since. Only a writer of the record may sign it, and
+// only once: the signature stands until the record is written again
+func (t *SimpleAsset) signRecord(stub shim.ChaincodeStubInterface, args []string, sigKey []byte) (string, error) {
+	k, err := t.importSigningKey(sigKey)
+	if err != nil {
+		return "", errorf(codeCryptoError, "importSigningKey failed, err %s", err)
+	}
+
+	if len(args) != 2 {
+		return "", errorf(codeBadRequest, "Expected 2 parameters to function signRecord")
+	}
+
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	if value == nil {
+		return "", errorf(codeNotFound, "Asset not found: %s", args[0])
+	}
+	err = checkRecordIssuer(stub, value)
+	if err != nil {
+		return "", err
+	}
+	err = checkWriter(stub, key)
+	if err != nil {
+		return "", err
+	}
+	sigKeyName, err := recordIndexKey(stub, sigIndex, key)
+	if err != nil {
+		return "", err
+	}
+	existing, err := stub.GetState(sigKeyName)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get signature of asset: %s with error: %s", args[0], err)
+	}
+	if len(existing) != 0 {
+		return "", errorf(codeConflict, "Asset %s is already signed", args[0])
+	}
+
+	signature, err := t.sign(k, value)
+	if err != nil {
+		return "", errorf(codeCryptoError, "sign failed, err %s", err)
+	}
+	err = stub.PutState(sigKeyName, signature)
+	if err != nil {
+		return "", fmt.Errorf("Failed to set signature of asset: %s", args[0])
+	}
+	return hex.EncodeToString(signature), nil
+}
+
+type signatureCheck struct {
+	Key   string `json:"key"`
+	Valid bool   `json:"valid"`
+}
+
+// verifyRecord reports whether the stored value of the asset at args[0:2]
+// still matches the signature stored for it, under the supplied PEM
+// encoded public key. Invoked with a candidate record as well, the
+// function runs verifyRecordValue instead
+func (t *SimpleAsset) verifyRecord(stub shim.ChaincodeStubInterface, args []string, verKey []byte) (string, error) {
+	k, err := t.importVerificationKey(verKey)
+	if err != nil {
+		return "", errorf(codeCryptoError, "importVerificationKey failed, err %s", err)
+	}
+
+	if len(args) != 2 {
+		return "", errorf(codeBadRequest, "Expected 2 parameters to function verifyRecord")
+	}
+
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	if len(value) == 0 {
+		value = nil
+	}
+	// checked before telling whether the record exists
+	err = checkReader(stub, key, args[0], value)
+	if err != nil {
+		return "", err
+	}
+	if value == nil {
+		return "", errorf(codeNotFound, "Asset not found: %s", args[0])
+	}
+	signature, err := getSignature(stub, key)
+	if err != nil {
+		return "", err
+	}
+
+	// a malformed signature is as invalid as a mismatching one
+	ok, verr := t.verify(k, signature, value)
+	b, err := json.Marshal(signatureCheck{key, ok && verr == nil})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+type bundleRecord struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type bundleContents struct {
+	Owner   string         `json:"owner"`
+	Count   int            `json:"count"`
+	Records []bundleRecord `json:"records"`
+}
+
+type signedBundle struct {
+	// Contents is the json-marshalled bundleContents the digest and the
+	// signature are computed over
+	Contents  []byte `json:"contents"`
+	Digest    string `json:"digest"`
+	Signature []byte `json:"signature"`
+	PublicKey string `json:"publicKey"`
+}
+
+// exportSignedBundle gathers the stored values of all the records of the
+// owner in args[0] the caller may read into a bundle signed with the
+// supplied ECDSA key, so that an external party holding the public key
+// can check that the extract is authentic and, thanks to the record
+// count, complete
+func (t *SimpleAsset) exportSignedBundle(stub shim.ChaincodeStubInterface, args []string, sigKey []byte) (string, error) {
+	if len(args) != 1 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting an owner")
+	}
+	k, err := t.importSigningKey(sigKey)
+	if err != nil {
+		return "", errorf(codeCryptoError, "importSigningKey failed, err %s", err)
+	}
+
+	contents := bundleContents{Owner: args[0], Records: []bundleRecord{}}
+	err = forEachOwnerRecord(stub, args[0], readable(stub, func(key string, value []byte) error {
+		contents.Records = append(contents.Records, bundleRecord{key, value})
+		return nil
+	}))
+	if err != nil {
+		return "", err
+	}
+	contents.Count = len(contents.Records)
+
+	b, err := json.Marshal(contents)
+	if err != nil {
+		return "", err
+	}
+	digest, err := t.bccspInst.Hash(b, &bccsp.SHA256Opts{})
+	if err != nil {
+		return "", fmt.Errorf("bccspInst.Hash failed, err %s", err)
+	}
+	signature, err := t.sign(k, b)
+	if err != nil {
+		return "", errorf(codeCryptoError, "sign failed, err %s", err)
+	}
+	pub, err := publicKeyPEM(k)
+	if err != nil {
+		return "", fmt.Errorf("publicKeyPEM failed, err %s", err)
+	}
+
+	b, err = json.Marshal(signedBundle{b, hex.EncodeToString(digest), signature, pub})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+type commitmentResult struct {
+	Key   string `json:"key"`
+	Match bool   `json:"match"`
+}
+
+// verifyCommitment checks whether the SHA-256 of the stored value of a
+// record equals the hex encoded commitment in args[2], e.g. a hash that
+// was published off-chain, and reports whether it matches
+func (t *SimpleAsset) verifyCommitment(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 3 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key and a commitment")
+	}
+	commitment, err := hex.DecodeString(args[2])
+	if err != nil {
+		return "", errorf(codeBadRequest, "Invalid commitment %s", args[2])
+	}
+
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	if len(value) == 0 {
+		value = nil
+	}
+	// checked before telling whether the record exists
+	err = checkReader(stub, key, args[0], value)
+	if err != nil {
+		return "", err
+	}
+	if value == nil {
+		return "", errorf(codeNotFound, "Asset not found: %s", args[0])
+	}
+
+	h, err := t.bccspInst.Hash(value, &bccsp.SHA256Opts{})
+	if err != nil {
+		return "", fmt.Errorf("bccspInst.Hash failed, err %s", err)
+	}
+
+	b, err := json.Marshal(commitmentResult{key, bytes.Equal(h, commitment)})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// verifierEntity is an encrypter entity that verifies signatures against
+// a public key, for the entities helpers to verify records without the
+// private key of their writer
+type verifierEntity struct {
+	entities.EncrypterEntity
+	t *SimpleAsset
+	k bccsp.Key
+}
+
+func (e *verifierEntity) Sign(msg []byte) ([]byte, error) {
+	return nil, errors.New("a verifier entity cannot sign")
+}
+
+func (e *verifierEntity) Verify(signature, msg []byte) (bool, error) {
+	return e.t.verify(e.k, signature, msg)
+}
+
+// encSignRecord signs the record with the supplied ECDSA key and encrypts
+// it together with its signature, so that unlike with encryptSignRecord
+// the signature can only be checked, with decVerifyRecord, by the holders
+// of the encryption key. An IV cannot be supplied: every write gets a
+// random one. Such records are not readable with decRecord
+func (t *SimpleAsset) encSignRecord(stub shim.ChaincodeStubInterface, args []string, encKey, sigKey []byte) (string, error) {
+	ent, err := entities.NewAES256EncrypterECDSASignerEntity("ID", t.bccspInst, encKey, sigKey)
+	if err != nil {
+		return "", errorf(codeCryptoError, "entities.NewAES256EncrypterECDSASignerEntity failed, err %s", err)
+	}
+
+	if len(args) != 3 {
+		return "", errorf(codeBadRequest, "Expected 3 parameters to function encSignRecord")
+	}
+	value, event, err := t.putEncrypted(stub, encKey, args, func(key, value string) ([]byte, error) {
+		stored, err := signAndEncrypt(ent, []byte(value))
+		if err != nil {
+			return nil, errorf(codeCryptoError, "signAndEncrypt failed, err %+v", err)
+		}
+		return stored, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	err = emitEvent(stub, event)
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// decVerifyRecord decrypts a record written by encSignRecord and returns
+// it only if its signature verifies against the supplied PEM encoded
+// public key. A record that decrypts but is not signed by that key fails
+// with errSignatureInvalid, unlike one that does not decrypt
+func (t *SimpleAsset) decVerifyRecord(stub shim.ChaincodeStubInterface, args []string, decKey, verKey []byte) (string, error) {
+	aesEnt, err := entities.NewAES256EncrypterEntity("ID", t.bccspInst, decKey, nil)
+	if err != nil {
+		return "", errorf(codeCryptoError, "entities.NewAES256EncrypterEntity failed, err %s", err)
+	}
+	k, err := t.importVerificationKey(verKey)
+	if err != nil {
+		return "", errorf(codeCryptoError, "importVerificationKey failed, err %s", err)
+	}
+	ent := &verifierEntity{EncrypterEntity: aesEnt, t: t, k: k}
+
+	if len(args) != 2 {
+		return "", errorf(codeBadRequest, "Expected 2 parameters to function decVerifyRecord")
+	}
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	// the peer treats an empty value as a deleted one
+	if len(value) == 0 {
+		value = nil
+	}
+	// checked before telling whether the record exists
+	err = checkReader(stub, key, args[0], value)
+	if err != nil {
+		return "", err
+	}
+	if value == nil {
+		return "", errorf(codeNotFound, "Asset not found: %s", args[0])
+	}
+
+	cleartextValue, err := getStateDecryptAndVerify(stub, ent, key)
+	if err == errSignatureInvalid {
+		return "", err
+	}
+	if err != nil {
+		return "", errorf(codeCryptoError, "getStateDecryptAndVerify failed, err %s", err)
+	}
+	result, err := parseRecord(cleartextValue)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	return result, nil
+}
@@ -0,0 +1,228 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/pkg/errors"
+)
+
+// snapIndex is the composite key object type snapshots are stored under,
+// keyed by record key and snapshot id
+const snapIndex = "snap"
+
+// recordSnapshot is the stored value of a record together with the
+// metadata kept about it, indexed by metadata object type
+type recordSnapshot struct {
+	Value []byte            `json:"value"`
+	Meta  map[string][]byte `json:"meta"`
+}
+
+// snapshotRecord saves a copy of the stored value of the asset at
+// args[0:2] under the snapshot id args[2], to be rolled back to with
+// restoreSnapshot. Like the rollback, it is restricted to the writers of
+// the record. Snapshot ids are scoped to the record and cannot be reused
+func snapshotRecord(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 3 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key and a snapshot id")
+	}
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	if value == nil {
+		return "", errorf(codeNotFound, "Asset not found: %s", args[0])
+	}
+	err = checkWriter(stub, key)
+	if err != nil {
+		return "", err
+	}
+
+	snapKey, err := recordIndexKey(stub, snapIndex, key, args[2])
+	if err != nil {
+		return "", err
+	}
+	existing, err := stub.GetState(snapKey)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get snapshot: %s with error: %s", args[2], err)
+	}
+	if existing != nil {
+		return "", errorf(codeConflict, "Snapshot already exists: %s", args[2])
+	}
+
+	snap := recordSnapshot{Value: value, Meta: map[string][]byte{}}
+	for _, index := range recordMetaIndexes {
+		indexKey, err := recordIndexKey(stub, index, key)
+		if err != nil {
+			return "", err
+		}
+		meta, err := stub.GetState(indexKey)
+		if err != nil {
+			return "", err
+		}
+		if meta != nil {
+			snap.Meta[index] = meta
+		}
+	}
+
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return "", err
+	}
+	err = stub.PutState(snapKey, b)
+	if err != nil {
+		return "", fmt.Errorf("Failed to set snapshot: %s", args[2])
+	}
+	return args[2], nil
+}
+
+// restoredValue returns the value to store when the record at key is
+// rolled back to the plaintext snapshot value snap: its document with a
+// version past both that of the snapshot and the current one, and the
+// transaction time as update time, so that updateRecord rejects the
+// versions read before the rollback. Other values are returned as is
+func restoredValue(stub shim.ChaincodeStubInterface, key string, snap []byte) ([]byte, error) {
+	r := Record{}
+	if json.Unmarshal(snap, &r) != nil {
+		return snap, nil
+	}
+	current, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	old := Record{}
+	if json.Unmarshal(current, &old) == nil && old.Version > r.Version {
+		r.Version = old.Version
+	}
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, errors.WithMessage(err, "could not get transaction timestamp")
+	}
+	r.Version++
+	r.UpdatedAt = formatTimestamp(ts)
+	value, err := r.document()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+// restoreSnapshot rolls the asset at args[0:2] back to the value it had
+// when the snapshot args[2] was taken, as a new version of the record.
+// The snapshot is kept, so that the record can be rolled back to it again
+func restoreSnapshot(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) != 3 {
+		return "", errorf(codeBadRequest, "Incorrect arguments. Expecting a key and a snapshot id")
+	}
+	key, err := resolveKey(stub, args[0], args[1], false)
+	if err != nil {
+		return "", err
+	}
+	snapKey, err := recordIndexKey(stub, snapIndex, key, args[2])
+	if err != nil {
+		return "", err
+	}
+	b, err := stub.GetState(snapKey)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get snapshot: %s with error: %s", args[2], err)
+	}
+	if b == nil {
+		return "", errorf(codeNotFound, "Snapshot not found: %s", args[2])
+	}
+	snap := recordSnapshot{}
+	err = json.Unmarshal(b, &snap)
+	if err != nil {
+		return "", errorf(codeBadRequest, "Invalid snapshot %s: %s", args[2], err)
+	}
+
+	err = checkNotRevoked(stub, key)
+	if err != nil {
+		return "", err
+	}
+	_, encrypted := snap.Meta[encIndex]
+	value := snap.Value
+	if !encrypted {
+		err = checkPlaintextAllowed(stub)
+		if err != nil {
+			return "", err
+		}
+		value, err = restoredValue(stub, key, snap.Value)
+		if err != nil {
+			return "", fmt.Errorf("Failed to restore asset: %s with error: %s", args[0], err)
+		}
+		err = checkIssuer(stub, string(value))
+		if err != nil {
+			return "", err
+		}
+	}
+	err = checkOwnerQuota(stub, key, len(value))
+	if err != nil {
+		return "", err
+	}
+	err = checkWriter(stub, key)
+	if err != nil {
+		return "", err
+	}
+	event, err := newWriteEvent(stub, key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset: %s with error: %s", args[0], err)
+	}
+	event.Encrypted = encrypted
+	key, err = namespaceKey(stub, key, event.Encrypted)
+	if err != nil {
+		return "", fmt.Errorf("Failed to set asset: %s with error: %s", args[0], err)
+	}
+	err = stub.PutState(key, value)
+	if err != nil {
+		return "", fmt.Errorf("Failed to set asset: %s", args[0])
+	}
+	// an encrypted record is restored verbatim, along with its metadata;
+	// a plaintext one is a new version, which none of it applies to
+	if encrypted {
+		err = restoreRecordMeta(stub, key, snap.Meta)
+	} else {
+		err = clearRecordMeta(stub, key)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to set asset: %s", args[0])
+	}
+	err = trackModifier(stub, key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to track modifier of asset: %s with error: %s", args[0], err)
+	}
+	err = emitEvent(stub, event)
+	if err != nil {
+		return "", err
+	}
+	return args[2], nil
+}
+
+// restoreRecordMeta replaces the metadata of key with that in meta
+func restoreRecordMeta(stub shim.ChaincodeStubInterface, key string, meta map[string][]byte) error {
+	for _, index := range recordMetaIndexes {
+		indexKey, err := recordIndexKey(stub, index, key)
+		if err != nil {
+			return err
+		}
+		if m, in := meta[index]; in {
+			err = stub.PutState(indexKey, m)
+		} else {
+			err = stub.DelState(indexKey)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
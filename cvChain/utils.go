@@ -53,6 +53,10 @@ func encryptAndPutState(stub shim.ChaincodeStubInterface, ent entities.Encrypter
 	return stub.PutState(key, ciphertext)
 }
 
+// errSignatureInvalid is returned by getStateDecryptAndVerify when the
+// state decrypts but the signature over it does not verify
+var errSignatureInvalid = errorf(codeCryptoError, "signature invalid")
+
 // getStateDecryptAndVerify retrieves the value associated to key,
 // decrypts it with the supplied entity, verifies the signature
 // over it and returns the result of the decryption in case of
@@ -61,7 +65,7 @@ func getStateDecryptAndVerify(stub shim.ChaincodeStubInterface, ent entities.Enc
 	// here we retrieve and decrypt the state associated to key
 	val, err := getStateAndDecrypt(stub, ent, key)
 	if err != nil {
-		return nil, err
+		return nil, errors.WithMessage(err, "decryption failed")
 	}
 
 	// we unmarshal a SignedMessage from the decrypted state
@@ -73,10 +77,8 @@ func getStateDecryptAndVerify(stub shim.ChaincodeStubInterface, ent entities.Enc
 
 	// we verify the signature
 	ok, err := msg.Verify(ent)
-	if err != nil {
-		return nil, err
-	} else if !ok {
-		return nil, errors.New("invalid signature")
+	if err != nil || !ok {
+		return nil, errSignatureInvalid
 	}
 
 	return msg.Payload, nil
@@ -87,23 +89,35 @@ func getStateDecryptAndVerify(stub shim.ChaincodeStubInterface, ent entities.Enc
 // supplied entity and puts it to the ledger associated to
 // the supplied KVS key
 func signEncryptAndPutState(stub shim.ChaincodeStubInterface, ent entities.EncrypterSignerEntity, key string, value []byte) error {
+	ciphertext, err := signAndEncrypt(ent, value)
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(key, ciphertext)
+}
+
+// signAndEncrypt signs the supplied value using the supplied
+// entity and returns the encryption of the value along with
+// its signature
+func signAndEncrypt(ent entities.EncrypterSignerEntity, value []byte) ([]byte, error) {
 	// here we create a SignedMessage, set its payload
 	// to value and the ID of the entity and
 	// sign it with the entity
 	msg := &entities.SignedMessage{Payload: value, ID: []byte(ent.ID())}
 	err := msg.Sign(ent)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// here we serialize the SignedMessage
 	b, err := msg.ToBytes()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// here we encrypt the serialized version associated to args[0]
-	return encryptAndPutState(stub, ent, key, b)
+	// here we encrypt the serialized version
+	return ent.Encrypt(b)
 }
 
 type keyValuePair struct {